@@ -0,0 +1,238 @@
+package changedpkgs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gitlab.com/matthewhughes/slogctx"
+	"golang.org/x/tools/go/packages"
+)
+
+// files outside a package's directory that its cgo preambles refer to,
+// relative to the tree.
+type cgoRefs struct {
+	// headers in #include directives, including those included by other
+	// such headers
+	files map[string]struct{}
+	// directories given with -I in #cgo directives, where any file may be
+	// included
+	dirs map[string]struct{}
+}
+
+// mark local packages changed by files their cgo preambles refer to, which
+// aren't in the package's directory, so aren't listed as its files.
+func collectCgoFiles(
+	ctx context.Context,
+	changes []fileChange,
+	pkgs []*packages.Package,
+	treeDir string,
+	changedPackages map[string]*Reasons,
+) {
+	for _, pkg := range pkgs {
+		if pkg.ID != pkg.PkgPath {
+			// cgo can't be used in tests
+			continue
+		}
+		refs := getCgoRefs(ctx, pkg, treeDir)
+		for _, change := range changes {
+			for _, file := range []string{change.path, change.oldPath} {
+				if file == "" {
+					continue
+				}
+				_, included := refs.files[file]
+				_, inDir := refs.dirs[filepath.Dir(file)]
+				if !included && !inDir {
+					continue
+				}
+				slogctx.FromContext(ctx).Debug(
+					"package detected changed because of file included by cgo",
+					"package",
+					pkg.PkgPath,
+					"file",
+					file,
+				)
+				addReasons(changedPackages, pkg.ID, Reasons{Files: []string{file}})
+			}
+		}
+	}
+}
+
+// an #include directive in a cgo preamble or header.
+type cgoInclude struct {
+	// the directory of the file containing the directive
+	dir    string
+	header string
+	// whether the header is quoted, so searched for in `dir` first, rather
+	// than in angle brackets
+	quoted bool
+}
+
+// get the files `pkg` refers to in the cgo preambles of its Go files,
+// including those excluded by build constraints, whatever constraints the
+// #cgo directives have.
+func getCgoRefs(ctx context.Context, pkg *packages.Package, treeDir string) cgoRefs {
+	refs := cgoRefs{files: map[string]struct{}{}, dirs: map[string]struct{}{}}
+	var includeDirs []string
+	var includes []cgoInclude
+	for _, file := range slices.Concat(pkg.GoFiles, pkg.IgnoredFiles) {
+		if !strings.HasSuffix(file, ".go") {
+			continue
+		}
+		preamble, err := getCgoPreamble(file)
+		if err != nil {
+			// ignored files may not parse, and don't need to
+			slogctx.FromContext(ctx).Debug("failed to parse cgo preamble", "file", file, "error", err)
+			continue
+		}
+		for _, line := range strings.Split(preamble, "\n") {
+			if include, ok := parseInclude(pkg.Dir, line); ok {
+				includes = append(includes, include)
+			} else if directive, ok := strings.CutPrefix(strings.TrimSpace(line), "#cgo "); ok {
+				includeDirs = append(includeDirs, parseIncludeDirs(directive, pkg.Dir)...)
+			}
+		}
+	}
+
+	for _, dir := range includeDirs {
+		if relDir, ok := relToTree(treeDir, dir); ok && dir != pkg.Dir {
+			refs.dirs[relDir] = struct{}{}
+		}
+	}
+
+	// follow the includes in the included headers too. Every path a header
+	// could be found at is added, whether it exists or not, as it may have
+	// been deleted
+	seen := map[string]struct{}{}
+	for len(includes) > 0 {
+		include := includes[0]
+		includes = includes[1:]
+		var paths []string
+		if include.quoted {
+			paths = append(paths, filepath.Join(include.dir, include.header))
+		}
+		for _, dir := range includeDirs {
+			paths = append(paths, filepath.Join(dir, include.header))
+		}
+
+		for _, header := range paths {
+			relHeader, inTree := relToTree(treeDir, header)
+			if _, ok := seen[header]; ok || !inTree {
+				// system headers can't change
+				continue
+			}
+			seen[header] = struct{}{}
+			if filepath.Dir(header) != pkg.Dir {
+				// files in the package directory are attributed to it anyway
+				refs.files[relHeader] = struct{}{}
+			}
+			data, err := os.ReadFile(header)
+			if err != nil {
+				continue
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				if include, ok := parseInclude(filepath.Dir(header), scanner.Text()); ok {
+					includes = append(includes, include)
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// get `path` relative to the tree, if it's in the tree.
+func relToTree(treeDir, path string) (string, bool) {
+	relPath, err := filepath.Rel(treeDir, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return relPath, true
+}
+
+// get the preamble for `import "C"` in the Go file at `path`, or "" if it
+// doesn't use cgo.
+func getCgoPreamble(path string) (string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	for _, decl := range file.Decls {
+		// with ImportsOnly, there are only import declarations
+		genDecl := decl.(*ast.GenDecl) //nolint:errcheck
+		for _, spec := range genDecl.Specs {
+			importSpec := spec.(*ast.ImportSpec) //nolint:errcheck
+			if importSpec.Path.Value != `"C"` {
+				continue
+			}
+			// as cgo does, use the comment on the declaration if there's
+			// no comment on the import itself
+			doc := importSpec.Doc
+			if doc == nil && len(genDecl.Specs) == 1 {
+				doc = genDecl.Doc
+			}
+			return doc.Text(), nil
+		}
+	}
+	return "", nil
+}
+
+// parse an #include directive in a file in `dir`.
+func parseInclude(dir, line string) (cgoInclude, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "#include")
+	if !ok {
+		return cgoInclude{}, false
+	}
+	rest = strings.TrimSpace(rest)
+	if header, ok := strings.CutPrefix(rest, "<"); ok {
+		header, _, ok = strings.Cut(header, ">")
+		return cgoInclude{dir: dir, header: header}, ok
+	}
+	header, err := strconv.Unquote(rest)
+	return cgoInclude{dir: dir, header: header, quoted: true}, err == nil
+}
+
+// parse the include directories given with -I in a #cgo directive, with
+// the `#cgo ` prefix removed, like `linux CFLAGS: -I${SRCDIR}/include`.
+func parseIncludeDirs(directive, pkgDir string) []string {
+	names, flags, ok := strings.Cut(directive, ":")
+	if !ok {
+		return nil
+	}
+	fields := strings.Fields(names)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch fields[len(fields)-1] {
+	case "CFLAGS", "CPPFLAGS", "CXXFLAGS":
+	default:
+		return nil
+	}
+
+	var dirs []string
+	args := strings.Fields(strings.ReplaceAll(flags, "${SRCDIR}", pkgDir))
+	for i, arg := range args {
+		var dir string
+		switch {
+		case arg == "-I" && i+1 < len(args):
+			dir = args[i+1]
+		case strings.HasPrefix(arg, "-I") && arg != "-I":
+			dir = arg[len("-I"):]
+		default:
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(pkgDir, dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return dirs
+}
@@ -0,0 +1,1202 @@
+// Package changedpkgs finds the Go packages that changed between two Git
+// refs, either directly through their files or indirectly through the
+// packages and modules they import.
+package changedpkgs
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gitlab.com/matthewhughes/slogctx"
+	"golang.org/x/tools/go/packages"
+)
+
+// GoVersionChanges controls which packages are changed when the go or
+// toolchain version of a module changes.
+type GoVersionChanges string
+
+const (
+	// GoVersionChangesAll considers all packages of the module changed, and
+	// the local packages importing them, or all local packages for a change
+	// to the go.work.
+	GoVersionChangesAll GoVersionChanges = "all"
+	// GoVersionChangesStdlib considers only packages importing the standard
+	// library, directly or indirectly, changed.
+	GoVersionChangesStdlib GoVersionChanges = "stdlib"
+	// GoVersionChangesNone ignores changes to go and toolchain versions.
+	GoVersionChangesNone GoVersionChanges = "none"
+)
+
+// Order controls the order of [Result.Packages].
+type Order string
+
+const (
+	// OrderLexical orders packages by import path.
+	OrderLexical Order = "lexical"
+	// OrderTopological orders packages after the local packages they import,
+	// ignoring imports from tests.
+	OrderTopological Order = "topological"
+)
+
+// Options configures [Get].
+type Options struct {
+	// the Git repo to inspect, defaults to the current directory
+	RepoDir string
+	// the directory containing go.mod, inside RepoDir. Defaults to the
+	// current directory
+	ModDir  string
+	FromRef string
+	// the ref to compare FromRef against. If empty, FromRef is compared
+	// against the working tree, including untracked files, or the index if
+	// Staged is set
+	ToRef string
+	// compare FromRef against the index rather than the working tree, can't
+	// be used with ToRef
+	Staged bool
+	// compare against the merge base of FromRef and ToRef (or HEAD, without
+	// ToRef) rather than FromRef itself, like `git diff FromRef...ToRef`
+	MergeBase bool
+	// load packages from every module in the Go workspace containing ModDir,
+	// or if there's no go.work, from every module under ModDir, so changes
+	// propagate between local modules
+	Workspace bool
+	// also consider packages changed when their tests import a changed
+	// package
+	IncludeTestDeps bool
+	// defaults to GoVersionChangesAll
+	GoVersionChanges GoVersionChanges
+	// defaults to OrderLexical
+	Order Order
+	// package patterns, as accepted by `go list`, selecting the packages to
+	// load and report. Relative patterns are relative to ModDir. Defaults to
+	// all packages in the module, or the workspace with Workspace. Changes
+	// still propagate through other local packages the selected packages
+	// import. Meta patterns like "all", and absolute directories, aren't
+	// supported, and packages outside the loaded modules aren't reported
+	Patterns []string
+	// package patterns, like Patterns, for packages to leave out of the
+	// result. Changes still propagate through these packages
+	Exclude []string
+	// mark packages changed when files not belonging to them change, see
+	// [ReadConfig]
+	Triggers []Trigger
+	// path to a config file whose triggers are used as well as Triggers.
+	// A relative path is relative to RepoDir, and read from the version
+	// compared against, like the packages are
+	ConfigPath string
+	// ignore ConfigPath if it doesn't exist, e.g. when it's the default
+	ConfigOptional bool
+	// consider any file in a package's directory, or in a subdirectory
+	// that isn't itself a package's directory, part of the package, e.g.
+	// README.md or a config file the package reads at runtime
+	DirFiles bool
+	// globs, as for [Trigger.Files], of files to leave out with DirFiles.
+	// Globs without a / match the file name in any directory
+	DirFilesIgnore []string
+	// build tags to load packages with
+	Tags []string
+	// platforms, like linux/amd64, to load packages for. Changes found for
+	// any of them are included. Defaults to the host platform
+	Platforms []string
+}
+
+// Status describes how a package changed.
+type Status string
+
+const (
+	// StatusAdded is a package that didn't exist at [Options.FromRef].
+	StatusAdded Status = "added"
+	// StatusModified is a package that exists at both versions.
+	StatusModified Status = "modified"
+	// StatusRemoved is a package that no longer exists.
+	StatusRemoved Status = "removed"
+)
+
+// Result holds the changes found by [Get].
+type Result struct {
+	// added and modified packages
+	Packages []Package `json:"packages"`
+	// packages that existed at [Options.FromRef] but no longer exist
+	Removed []Package `json:"removed"`
+
+	// changed packages left out of Packages by [Options.Patterns] or
+	// [Options.Exclude], so [Result.Why] can follow changes through them
+	unreported []Package
+}
+
+// Package is a changed package.
+type Package struct {
+	PkgPath string `json:"package"`
+	// the package name, "main" for commands
+	Name string `json:"name"`
+	// the directory containing the package, relative to the repo. For a
+	// removed package, this is where it was at [Options.FromRef]
+	Dir    string `json:"dir"`
+	Status Status `json:"status"`
+	// only the package's tests are affected by the change, not the package
+	// itself
+	TestsOnly bool    `json:"testsOnly"`
+	Reasons   Reasons `json:"reasons"`
+}
+
+// Reasons describes why a package is considered changed.
+type Reasons struct {
+	// changed files belonging to the package, or triggering a change to it
+	// (see [Trigger]), relative to the repo. For an added or removed package
+	// with no such files, the changed go.mod or go.work files that moved it
+	// between modules
+	Files []string `json:"files,omitempty"`
+	// changed modules the package imports packages from, directly or
+	// indirectly through other 3rd party packages. The standard library is
+	// included as "std" when a go or toolchain version changed
+	Modules []string `json:"modules,omitempty"`
+	// changed local packages the package imports
+	Dependencies []string `json:"dependencies,omitempty"`
+}
+
+func (r *Reasons) merge(other Reasons) {
+	r.Files = append(r.Files, other.Files...)
+	r.Modules = append(r.Modules, other.Modules...)
+	r.Dependencies = append(r.Dependencies, other.Dependencies...)
+}
+
+func (r *Reasons) isEmpty() bool {
+	return len(r.Files) == 0 && len(r.Modules) == 0 && len(r.Dependencies) == 0
+}
+
+// add `reasons` to those for the package with the given ID, marking it changed.
+func addReasons(
+	changedPackages map[string]*Reasons,
+	id string,
+	reasons Reasons,
+) {
+	if existing, ok := changedPackages[id]; ok {
+		existing.merge(reasons)
+	} else {
+		changedPackages[id] = &reasons
+	}
+}
+
+// Get the packages that are changed between [Options.FromRef] and
+// [Options.ToRef], where 'changed' means:
+//
+//   - The package contains a file that was changed between the two SHAs
+//   - The package's embed patterns match different files at each SHA, e.g.
+//     because a pattern changed
+//   - The package imports a package from a 3rd party module that was changed between the to SHAs
+//     (i.e. the version selected in the module graph changed, including through a new
+//     requirement, or any change to a replacement of the module, or to the contents of a local
+//     directory replacing it, or to the go.sum hash of the module version used, which is
+//     logged as a warning),
+//     or a 3rd party package that, directly or indirectly, imports such a package
+//   - The package imports a local package for which either of the above holds
+//   - A file the package's cgo preambles include changed, either directly or
+//     through other headers, or a file in a directory they add with -I
+//   - A file in the package's testdata directory changed, which only affects
+//     the package's tests
+//   - The go or toolchain version of a module changed, or of the go.work
+//     used, which overrides the toolchain version of its modules, subject
+//     to [Options.GoVersionChanges]: either all packages of the module are
+//     changed (all packages for the go.work), or just those importing the
+//     standard library
+//
+// where the package includes its tests. A package's tests are only
+// considered changed because of what they import if
+// [Options.IncludeTestDeps] is set.
+func Get(ctx context.Context, opts Options) (Result, error) {
+	fromRef := opts.FromRef
+	if opts.ToRef != "" && opts.Staged {
+		return Result{}, fmt.Errorf("can't compare against both %s and the index", opts.ToRef)
+	}
+	switch opts.GoVersionChanges {
+	case "", GoVersionChangesAll, GoVersionChangesStdlib, GoVersionChangesNone:
+	default:
+		return Result{}, fmt.Errorf("unknown go version changes %q", opts.GoVersionChanges)
+	}
+	switch opts.Order {
+	case "", OrderLexical, OrderTopological:
+	default:
+		return Result{}, fmt.Errorf("unknown order %q", opts.Order)
+	}
+	to := target{ref: opts.ToRef, staged: opts.Staged}
+	if err := validatePatterns(slices.Concat(opts.Patterns, opts.Exclude)); err != nil {
+		return Result{}, err
+	}
+	// some bits require an absolute path, some don't. For simplicity just
+	// always use an absolute path
+	repoDir, err := filepath.Abs(opts.RepoDir)
+	if err != nil { //go-cov:skip // this is a bit of a hassle to test, and we don't really ever expect a failure
+		return Result{}, fmt.Errorf("failed building absolute path for %s: %w", opts.RepoDir, err)
+	}
+	modDir, err := filepath.Abs(opts.ModDir)
+	if err != nil { //go-cov:skip // as above
+		return Result{}, fmt.Errorf("failed building absolute path for %s: %w", opts.ModDir, err)
+	}
+	relModDir, err := filepath.Rel(repoDir, modDir)
+	if err != nil || !filepath.IsLocal(relModDir) {
+		return Result{}, fmt.Errorf("mod dir %s is not inside repo dir %s", modDir, repoDir)
+	}
+
+	if opts.MergeBase {
+		fromRef, err = getMergeBase(ctx, repoDir, fromRef, to)
+		if err != nil {
+			return Result{}, err
+		}
+		slogctx.FromContext(ctx).Info("comparing against merge base", "ref", fromRef)
+	}
+
+	changes, err := getChangedFiles(ctx, repoDir, fromRef, to)
+	if err != nil {
+		return Result{}, err
+	}
+	slogctx.FromContext(ctx).Info("changed files", "files", changes)
+
+	// load packages from a copy of `to` rather than whatever happens to be
+	// checked out, so the package graph matches the diff we're inspecting
+	treeDir, err := os.MkdirTemp("", "go-changed-pkgs-")
+	if err != nil { //go-cov:skip // we don't really ever expect a failure
+		return Result{}, fmt.Errorf("creating directory for tree at %s: %w", to, err)
+	}
+	defer os.RemoveAll(treeDir)
+
+	if err := exportTree(ctx, repoDir, to, treeDir); err != nil {
+		return Result{}, err
+	}
+
+	// loadTree creates a go.work if there's none for [Options.Workspace]
+	_, err = os.Stat(filepath.Join(treeDir, relModDir, "go.work"))
+	hadWorkFile := err == nil
+	pkgs, err := loadTree(ctx, treeDir, relModDir, opts, false)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// and likewise from a copy of `fromRef`, for anything that needs
+	// comparing against how it was
+	oldTreeDir, err := os.MkdirTemp("", "go-changed-pkgs-")
+	if err != nil { //go-cov:skip // we don't really ever expect a failure
+		return Result{}, fmt.Errorf("creating directory for tree at %s: %w", fromRef, err)
+	}
+	defer os.RemoveAll(oldTreeDir)
+
+	if err := exportTree(ctx, repoDir, target{ref: fromRef}, oldTreeDir); err != nil { //go-cov:skip // we've already diffed against this ref, so don't expect a failure
+		return Result{}, err
+	}
+	if opts.Workspace {
+		// resolve modules at `fromRef` in a workspace too, even if it's one
+		// created by loadTree. Any failure here means listing modules or
+		// loading packages at `fromRef` fails too, and is handled there
+		_, _ = findWorkspace(ctx, filepath.Join(oldTreeDir, relModDir))
+	}
+
+	// the go.work packages were loaded with, if any, whether or not
+	// [Options.Workspace] is set
+	workPath, err := getWorkPath(ctx, filepath.Join(treeDir, relModDir))
+	if err != nil { //go-cov:skip // we've just loaded packages from this directory, so don't expect a failure
+		return Result{}, err
+	}
+	if workPath == filepath.Join(treeDir, relModDir, "go.work") && !hadWorkFile {
+		// one created by loadTree, which doesn't exist when the modules are
+		// actually built, so doesn't override anything in their go.mod
+		workPath = ""
+	}
+	changedPackages, changedMods, goVersionFiles, err := collectChanges(
+		ctx,
+		changes,
+		pkgs,
+		repoDir,
+		treeDir,
+		oldTreeDir,
+		workPath,
+		fromRef,
+		to,
+	)
+	if err != nil {
+		return Result{}, err
+	}
+	described := describePackages(pkgs, treeDir)
+	oldPkgs := compareOldPackages(
+		ctx,
+		changes,
+		pkgs,
+		described,
+		treeDir,
+		oldTreeDir,
+		relModDir,
+		fromRef,
+		opts,
+		changedPackages,
+	)
+	config, err := readOptionsConfig(treeDir, to, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	triggers := slices.Concat(opts.Triggers, config.Triggers)
+	collectTriggers(ctx, triggers, changes, described, relModDir, changedPackages)
+	testBinaries := getTestBinaries(pkgs)
+	collectDirFiles(ctx, changes, described, testBinaries, opts, changedPackages)
+	collectCgoFiles(ctx, changes, pkgs, treeDir, changedPackages)
+
+	if _, ok := changedMods[_stdModule]; ok {
+		switch opts.GoVersionChanges {
+		case GoVersionChangesAll, "":
+			collectGoVersionChanges(ctx, pkgs, testBinaries, workPath, goVersionFiles, changedPackages)
+			// the packages importing those changed are found like any
+			// others, rather than from their use of the standard library
+			delete(changedMods, _stdModule)
+		case GoVersionChangesNone:
+			delete(changedMods, _stdModule)
+		}
+		// otherwise, with GoVersionChangesStdlib, the standard library is
+		// treated just like a changed 3rd party module
+	}
+
+	changedDeps := getChangedDeps(ctx, pkgs, changedMods)
+
+	// relies on package's dependencies being before the package itself in the list
+	// this is guaranteed by `loadLocalPackages`
+	for _, pkg := range pkgs {
+		if !opts.IncludeTestDeps && isTestVariant(pkg.ID, testBinaries) {
+			// only changes to the test files themselves count
+			continue
+		}
+		// check imports even for packages that are already changed, so we
+		// collect every reason for the change
+		reasons := getImportChanges(ctx, pkg.ID, pkg.Imports, changedDeps, changedPackages)
+		if !reasons.isEmpty() {
+			addReasons(changedPackages, pkg.ID, reasons)
+		}
+	}
+
+	changed, removed := classifyPackages(
+		foldTestVariants(changedPackages, testBinaries),
+		described,
+		oldPkgs,
+	)
+	reported := newPackageFilter(opts.Patterns, opts.Exclude, relModDir)
+	changed, unreported := reported.split(changed)
+	removed, _ = reported.split(removed)
+	sortPackages(changed, pkgs, testBinaries, opts.Order)
+	// removed packages have no position in `pkgs`
+	sortPackages(removed, nil, nil, OrderLexical)
+	return Result{Packages: changed, Removed: removed, unreported: unreported}, nil
+}
+
+// sort `changed` in place, either by import path or in the order packages
+// appear in `pkgs`, i.e. after the local packages they import (see
+// `loadLocalPackages`). Imports from tests are ignored for the latter, since
+// an external test package can import a package that imports the package
+// under test.
+func sortPackages(
+	changed []Package,
+	pkgs []*packages.Package,
+	testBinaries map[string]struct{},
+	order Order,
+) {
+	if order != OrderTopological {
+		slices.SortFunc(changed, func(a, b Package) int {
+			return strings.Compare(a.PkgPath, b.PkgPath)
+		})
+		return
+	}
+
+	positions := make(map[string]int, len(pkgs))
+	for i, pkg := range pkgs {
+		// test variants are listed after the package itself, so this is
+		// the package's own position whenever it has any non-test files
+		pkgPath := basePkgPath(pkg.ID, testBinaries)
+		if _, ok := positions[pkgPath]; !ok {
+			positions[pkgPath] = i
+		}
+	}
+	slices.SortFunc(changed, func(a, b Package) int {
+		return cmp.Compare(positions[a.PkgPath], positions[b.PkgPath])
+	})
+}
+
+// changed packages are tracked by package ID so that a change to a test
+// file doesn't propagate to importers of the package under test. Map these
+// IDs back onto the import path of the package they belong to, e.g. all of:
+//
+//   - example.com/foo
+//   - example.com/foo [example.com/foo.test]
+//   - example.com/foo_test [example.com/foo.test]
+//   - example.com/bar [example.com/foo.test]
+//   - example.com/foo.test
+//
+// are reported as example.com/foo, since they're all built only as part of
+// that package or its tests. Where only the latter four changed, just the
+// tests of example.com/foo are affected.
+func foldTestVariants(
+	changedPackages map[string]*Reasons,
+	testBinaries map[string]struct{},
+) []Package {
+	folded := map[string]*Package{}
+	for id, reasons := range changedPackages {
+		pkgPath := basePkgPath(id, testBinaries)
+		testsOnly := isTestVariant(id, testBinaries)
+
+		pkg, ok := folded[pkgPath]
+		if !ok {
+			pkg = &Package{PkgPath: pkgPath, TestsOnly: testsOnly}
+			folded[pkgPath] = pkg
+		}
+		pkg.TestsOnly = pkg.TestsOnly && testsOnly
+		pkg.Reasons.merge(*reasons)
+	}
+
+	changed := make([]Package, 0, len(folded))
+	for _, pkg := range folded {
+		reasons := &pkg.Reasons
+		for i, dep := range reasons.Dependencies {
+			reasons.Dependencies[i] = basePkgPath(dep, testBinaries)
+		}
+		// a test variant depending on the package under test isn't interesting
+		reasons.Dependencies = slices.DeleteFunc(
+			reasons.Dependencies,
+			func(dep string) bool { return dep == pkg.PkgPath },
+		)
+		for _, values := range []*[]string{
+			&reasons.Files,
+			&reasons.Modules,
+			&reasons.Dependencies,
+		} {
+			slices.Sort(*values)
+			*values = slices.Compact(*values)
+		}
+		changed = append(changed, *pkg)
+	}
+	return changed
+}
+
+// get the import path of the package the package with the given ID is built
+// as part of, see foldTestVariants.
+func basePkgPath(id string, testBinaries map[string]struct{}) string {
+	if testBinary, ok := testBinaryID(id); ok {
+		return strings.TrimSuffix(testBinary, ".test")
+	}
+	if _, ok := testBinaries[id]; ok {
+		return strings.TrimSuffix(id, ".test")
+	}
+	return id
+}
+
+// get the IDs of all test binaries (i.e. the generated main packages used to
+// run tests) in `pkgs`.
+func getTestBinaries(pkgs []*packages.Package) map[string]struct{} {
+	testBinaries := map[string]struct{}{}
+	for _, pkg := range pkgs {
+		if testBinary, ok := testBinaryID(pkg.ID); ok {
+			testBinaries[testBinary] = struct{}{}
+		}
+	}
+	return testBinaries
+}
+
+// whether the package with the given ID is only built when running tests.
+func isTestVariant(id string, testBinaries map[string]struct{}) bool {
+	if _, ok := testBinaryID(id); ok {
+		return true
+	}
+	_, ok := testBinaries[id]
+	return ok
+}
+
+// get the ID of the test binary a test variant of a package is built into,
+// these have IDs like "example.com/foo [example.com/foo.test]".
+func testBinaryID(id string) (string, bool) {
+	_, testBinary, ok := strings.Cut(id, " [")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(testBinary, "]"), true
+}
+
+func collectChanges(
+	ctx context.Context,
+	changes []fileChange,
+	pkgs []*packages.Package,
+	repoDir string,
+	treeDir string,
+	oldTreeDir string,
+	workPath string,
+	fromRef string,
+	to target,
+) (map[string]*Reasons, map[string]struct{}, map[string]struct{}, error) {
+	changedPackages := map[string]*Reasons{}
+	changedMods := map[string]struct{}{}
+	// the go.mod and go.work files whose go or toolchain version changed
+	goVersionFiles := map[string]struct{}{}
+	replacements := getLocalReplacements(pkgs)
+	localGoMods := getLocalGoMods(pkgs)
+	usedMods := getUsedModules(pkgs)
+	inWorkspace := workPath != "" && workPath != "off"
+
+	for _, change := range changes {
+		// as with any 3rd party module, packages using a replaced module
+		// will be found from their imports
+		for modPath, dir := range replacements {
+			for _, path := range []string{change.path, change.oldPath} {
+				if path != "" && fileInDir(dir, filepath.Join(treeDir, path)) {
+					slogctx.FromContext(ctx).Debug(
+						"module replaced by local directory detected changed because of file",
+						"module",
+						modPath,
+						"file",
+						path,
+					)
+					changedMods[modPath] = struct{}{}
+				}
+			}
+		}
+
+		path := change.path
+		if path == "" {
+			// deleted, see collectDeletions
+			continue
+		}
+
+		// only compare a go.mod that exists at both versions: all the
+		// requirements of a newly added module are new, so there's nothing
+		// to compare
+		if filepath.Base(path) == "go.mod" && change.oldPath == path {
+			_, isLocal := localGoMods[filepath.Join(treeDir, path)]
+			mods, err := getChangedMods(
+				ctx,
+				path,
+				repoDir,
+				treeDir,
+				oldTreeDir,
+				fromRef,
+				to,
+				isLocal,
+				inWorkspace,
+			)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			slogctx.FromContext(ctx).Info(
+				"changed 3rd party modules",
+				"go.mod",
+				path,
+				"modules",
+				mods,
+			)
+			if _, ok := mods[_stdModule]; ok {
+				goVersionFiles[filepath.Join(treeDir, path)] = struct{}{}
+			}
+			// with multiple local modules, a 3rd party module is changed if
+			// it's changed in any of them
+			for mod := range mods {
+				changedMods[mod] = struct{}{}
+			}
+		}
+
+		// likewise for the go.work packages were loaded with, which
+		// overrides parts of the go.mod of each module
+		if filepath.Join(treeDir, path) == workPath && change.oldPath == path {
+			mods, err := getChangedWorkMods(path, treeDir, oldTreeDir, fromRef, to)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			slogctx.FromContext(ctx).Info(
+				"changed 3rd party modules",
+				"go.work",
+				path,
+				"modules",
+				mods,
+			)
+			if _, ok := mods[_stdModule]; ok {
+				goVersionFiles[workPath] = struct{}{}
+			}
+			for mod := range mods {
+				changedMods[mod] = struct{}{}
+			}
+		}
+
+		// likewise only compare a go.sum that exists at both versions, which
+		// for a workspace is go.work.sum
+		if base := filepath.Base(path); (base == "go.sum" || base == "go.work.sum") && change.oldPath == path {
+			mods, err := getChangedSums(ctx, path, repoDir, treeDir, fromRef, to, usedMods)
+			if err != nil { //go-cov:skip // we've already diffed the file at both versions, so don't expect a failure
+				return nil, nil, nil, err
+			}
+			for mod := range mods {
+				changedMods[mod] = struct{}{}
+			}
+		}
+
+		for _, pkg := range pkgs {
+			if id, ok := fileOwner(pkg, treeDir, path); ok {
+				slogctx.FromContext(ctx).Debug(
+					"package detected changed because of file",
+					"package",
+					id,
+					"file",
+					path,
+				)
+				// don't stop at the first match: a file can belong to both a
+				// package and its test variant
+				addReasons(changedPackages, id, Reasons{Files: []string{path}})
+			}
+		}
+	}
+
+	return changedPackages, changedMods, goVersionFiles, nil
+}
+
+// mark packages changed by a go or toolchain version change in
+// `goVersionFiles`: all of them for the go.work at `workPath`, since its
+// versions are used for every module in the workspace, or otherwise those in
+// the module of each go.mod.
+func collectGoVersionChanges(
+	ctx context.Context,
+	pkgs []*packages.Package,
+	testBinaries map[string]struct{},
+	workPath string,
+	goVersionFiles map[string]struct{},
+	changedPackages map[string]*Reasons,
+) {
+	_, workChanged := goVersionFiles[workPath]
+	goMods := map[string]string{}
+	for _, pkg := range pkgs {
+		if pkg.Module != nil {
+			goMods[pkg.PkgPath] = pkg.Module.GoMod
+		}
+	}
+	for _, pkg := range pkgs {
+		// test binaries have no module, but are in their package's
+		goMod := goMods[basePkgPath(pkg.ID, testBinaries)]
+		if _, ok := goVersionFiles[goMod]; ok || workChanged {
+			slogctx.FromContext(ctx).Debug(
+				"package detected changed because of go version",
+				"package",
+				pkg.ID,
+			)
+			addReasons(changedPackages, pkg.ID, Reasons{Modules: []string{_stdModule}})
+		}
+	}
+}
+
+// compare the packages at `fromRef`, exported into `treeDir`, with those at
+// the new version `newPkgs`, loaded from `newTreeDir` as `pkgs`, if any files
+// were added or deleted (or renamed) since, or any Go files in packages
+// embedding files changed: otherwise the same packages, embedding the same
+// files, exist at both versions. Packages that contained deleted files, packages that only exist
+// at one of the versions, and packages whose embed patterns match different
+// files at each version, are marked changed, with packages that no longer
+// exist left in `changedPackages` under their old ID.
+//
+// Returns the packages at `fromRef` by import path, or nil if they weren't
+// loaded.
+func compareOldPackages(
+	ctx context.Context,
+	changes []fileChange,
+	pkgs []*packages.Package,
+	newPkgs map[string]Package,
+	newTreeDir string,
+	treeDir string,
+	relModDir string,
+	fromRef string,
+	opts Options,
+	changedPackages map[string]*Reasons,
+) map[string]Package {
+	var deleted []string
+	addedOrDeleted := false
+	for _, change := range changes {
+		if change.oldPath != change.path {
+			addedOrDeleted = true
+			if change.oldPath != "" {
+				deleted = append(deleted, change.oldPath)
+			}
+		}
+	}
+	if !addedOrDeleted && !changesEmbeds(changes, pkgs, newTreeDir) {
+		return nil
+	}
+	slogctx.FromContext(ctx).Info("deleted files", "files", deleted)
+
+	var oldPkgs []*packages.Package
+	// otherwise everything under the mod dir is new, so there are no
+	// packages at `fromRef`
+	if _, err := os.Stat(filepath.Join(treeDir, relModDir)); !errors.Is(err, fs.ErrNotExist) {
+		// the change may well fix packages that were broken at `fromRef`,
+		// so just compare against those that load
+		// the patterns may only match packages added since `fromRef`, which
+		// the go command would fail to find there, so select the packages
+		// they match after loading everything
+		oldOpts := opts
+		oldOpts.Patterns = nil
+		oldPkgs, err = loadTree(ctx, treeDir, relModDir, oldOpts, true)
+		if err != nil {
+			slogctx.FromContext(ctx).Warn(
+				"failed loading packages, so can't detect deleted files or removed packages",
+				"ref",
+				fromRef,
+				"error",
+				err,
+			)
+			return nil
+		}
+		if len(opts.Patterns) > 0 {
+			oldPkgs = selectPackages(oldPkgs, treeDir, newPackageFilter(opts.Patterns, nil, relModDir))
+		}
+	}
+
+	for _, path := range deleted {
+		for _, pkg := range oldPkgs {
+			if id, ok := fileOwner(pkg, treeDir, path); ok {
+				slogctx.FromContext(ctx).Debug(
+					"package detected changed because of deleted file",
+					"package",
+					id,
+					"file",
+					path,
+				)
+				addReasons(changedPackages, id, Reasons{Files: []string{path}})
+			}
+		}
+	}
+
+	pkgsByID := make(map[string]*packages.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		pkgsByID[pkg.ID] = pkg
+	}
+	for _, oldPkg := range oldPkgs {
+		if pkg, ok := pkgsByID[oldPkg.ID]; ok {
+			compareEmbedFiles(ctx, oldPkg, treeDir, pkg, newTreeDir, changedPackages)
+		}
+	}
+
+	oldPkgsByPath := describePackages(oldPkgs, treeDir)
+	for pkgPath, pkg := range oldPkgsByPath {
+		if _, ok := newPkgs[pkgPath]; !ok {
+			slogctx.FromContext(ctx).Debug("package detected removed", "package", pkgPath)
+			addReasons(changedPackages, pkgPath, Reasons{Files: getAddedOrRemovedFiles(changes, pkg.Dir)})
+		}
+	}
+	for pkgPath, pkg := range newPkgs {
+		if _, ok := oldPkgsByPath[pkgPath]; !ok {
+			slogctx.FromContext(ctx).Debug("package detected added", "package", pkgPath)
+			addReasons(changedPackages, pkgPath, Reasons{Files: getAddedOrRemovedFiles(changes, pkg.Dir)})
+		}
+	}
+	return oldPkgsByPath
+}
+
+// get the changed files that explain why the package in `dir`, relative to
+// the repo, was added or removed: those in `dir`, or failing that, go.mod and
+// go.work files in or above it, which may have moved it to another module.
+func getAddedOrRemovedFiles(changes []fileChange, dir string) []string {
+	var files, modFiles []string
+	for _, change := range changes {
+		for _, file := range []string{change.path, change.oldPath} {
+			if file == "" {
+				continue
+			}
+			base := filepath.Base(file)
+			if base == "go.mod" || base == "go.work" {
+				if _, ok := relToTree(filepath.Dir(file), dir); ok {
+					modFiles = append(modFiles, file)
+				}
+			} else if filepath.Dir(file) == dir {
+				files = append(files, file)
+			}
+		}
+	}
+	if len(files) > 0 {
+		return files
+	}
+	return modFiles
+}
+
+// whether any of the changed files is a Go file in a package that embeds
+// files, so may have changed which files it embeds.
+func changesEmbeds(changes []fileChange, pkgs []*packages.Package, treeDir string) bool {
+	for _, pkg := range pkgs {
+		if len(pkg.EmbedPatterns) == 0 {
+			continue
+		}
+		for _, change := range changes {
+			if slices.Contains(pkg.GoFiles, filepath.Join(treeDir, change.path)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mark `pkg` changed by any files it embeds at only one of the versions,
+// unless they're already attributed to it, e.g. because they were added.
+func compareEmbedFiles(
+	ctx context.Context,
+	oldPkg *packages.Package,
+	oldTreeDir string,
+	pkg *packages.Package,
+	treeDir string,
+	changedPackages map[string]*Reasons,
+) {
+	oldFiles := getEmbedFiles(oldPkg, oldTreeDir)
+	files := getEmbedFiles(pkg, treeDir)
+	var reasons Reasons
+	if existing, ok := changedPackages[pkg.ID]; ok {
+		reasons = *existing
+	}
+	for _, file := range slices.Sorted(maps.Keys(files)) {
+		if _, ok := oldFiles[file]; !ok && !slices.Contains(reasons.Files, file) {
+			slogctx.FromContext(ctx).Debug(
+				"package detected changed because of newly embedded file",
+				"package",
+				pkg.ID,
+				"file",
+				file,
+				"patterns",
+				pkg.EmbedPatterns,
+			)
+			addReasons(changedPackages, pkg.ID, Reasons{Files: []string{file}})
+		}
+	}
+	for _, file := range slices.Sorted(maps.Keys(oldFiles)) {
+		if _, ok := files[file]; !ok && !slices.Contains(reasons.Files, file) {
+			slogctx.FromContext(ctx).Debug(
+				"package detected changed because of file no longer embedded",
+				"package",
+				pkg.ID,
+				"file",
+				file,
+				"patterns",
+				oldPkg.EmbedPatterns,
+			)
+			addReasons(changedPackages, pkg.ID, Reasons{Files: []string{file}})
+		}
+	}
+}
+
+// get the files `pkg` embeds, relative to the tree it was loaded from.
+func getEmbedFiles(pkg *packages.Package, treeDir string) map[string]struct{} {
+	files := make(map[string]struct{}, len(pkg.EmbedFiles))
+	for _, file := range pkg.EmbedFiles {
+		// packages.Package uses absolute paths for files
+		relFile, _ := strings.CutPrefix(file, treeDir+string(filepath.Separator))
+		files[relFile] = struct{}{}
+	}
+	return files
+}
+
+// mark packages changed by changed files in their directories that don't
+// belong to them otherwise: the package's tests for files in its testdata
+// directory (including fuzz corpora under testdata/fuzz), and the package
+// itself for any other file with [Options.DirFiles]. Deleted files are owned
+// by the packages in the directories they were deleted from, if those
+// packages still exist.
+func collectDirFiles(
+	ctx context.Context,
+	changes []fileChange,
+	pkgs map[string]Package,
+	testBinaries map[string]struct{},
+	opts Options,
+	changedPackages map[string]*Reasons,
+) {
+	var ignored []func(string) bool
+	for _, glob := range opts.DirFilesIgnore {
+		match := matchGlob(glob)
+		if !strings.Contains(glob, "/") {
+			ignored = append(ignored, func(file string) bool { return match(path.Base(file)) })
+		} else {
+			ignored = append(ignored, match)
+		}
+	}
+
+	pkgsByDir := map[string][]string{}
+	for _, pkg := range pkgs {
+		dir := filepath.ToSlash(pkg.Dir)
+		pkgsByDir[dir] = append(pkgsByDir[dir], pkg.PkgPath)
+	}
+
+	for _, change := range changes {
+		for _, file := range []string{change.path, change.oldPath} {
+			if file == "" {
+				continue
+			}
+			pkgPaths, testdata := getDirOwners(pkgsByDir, filepath.ToSlash(file))
+			for _, pkgPath := range pkgPaths {
+				if testdata {
+					// mark the test binary, which is only there if the
+					// package has tests
+					testBinary := pkgPath + ".test"
+					if _, ok := testBinaries[testBinary]; !ok {
+						continue
+					}
+					slogctx.FromContext(ctx).Debug(
+						"package tests detected changed because of testdata file",
+						"package",
+						pkgPath,
+						"file",
+						file,
+					)
+					addReasons(changedPackages, testBinary, Reasons{Files: []string{file}})
+					continue
+				}
+
+				if !opts.DirFiles || slices.ContainsFunc(ignored, func(match func(string) bool) bool {
+					return match(filepath.ToSlash(file))
+				}) {
+					continue
+				}
+				slogctx.FromContext(ctx).Debug(
+					"package detected changed because of file in its directory",
+					"package",
+					pkgPath,
+					"file",
+					file,
+				)
+				addReasons(changedPackages, pkgPath, Reasons{Files: []string{file}})
+			}
+		}
+	}
+}
+
+// get the packages in the closest directory containing the slash separated
+// path `file` that contains any packages, and whether the file is in their
+// testdata directory.
+func getDirOwners(pkgsByDir map[string][]string, file string) ([]string, bool) {
+	dir := file
+	for dir != "." {
+		dir = path.Dir(dir)
+		if _, ok := pkgsByDir[dir]; ok {
+			break
+		}
+	}
+	relPath := file
+	if dir != "." {
+		relPath = strings.TrimPrefix(file, dir+"/")
+	}
+	return pkgsByDir[dir], strings.HasPrefix(relPath, "testdata/")
+}
+
+// select the packages in `pkgs` matched by `filter`, and the local packages
+// they import, like loading them with the filter's patterns would.
+func selectPackages(
+	pkgs []*packages.Package,
+	treeDir string,
+	filter packageFilter,
+) []*packages.Package {
+	described := describePackages(pkgs, treeDir)
+	testBinaries := getTestBinaries(pkgs)
+	var selected []*packages.Package
+	for _, pkg := range pkgs {
+		if filter.selects(described[basePkgPath(pkg.ID, testBinaries)]) {
+			selected = append(selected, pkg)
+		}
+	}
+	return withLocalDeps(selected)
+}
+
+// load local packages from the module at `relModDir` in the exported tree
+// at `treeDir`, or all modules in its workspace if [Options.Workspace] is
+// set, or just those matching [Options.Patterns] (and the local packages
+// they import). With `allowErrors`, packages that fail to load, e.g. because
+// of a syntax error, are left out rather than failing the whole load.
+func loadTree(
+	ctx context.Context,
+	treeDir string,
+	relModDir string,
+	opts Options,
+	allowErrors bool,
+) ([]*packages.Package, error) {
+	treeModDir := filepath.Join(treeDir, relModDir)
+	patterns := []string{"./..."}
+	var err error
+	if opts.Workspace {
+		patterns, err = getWorkspacePatterns(ctx, treeModDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Patterns) > 0 {
+		patterns = opts.Patterns
+	}
+
+	buildCfgs, err := getBuildConfigs(opts)
+	if err != nil {
+		return nil, err
+	}
+	graphs := make([][]*packages.Package, 0, len(buildCfgs))
+	for _, buildCfg := range buildCfgs {
+		pkgs, err := loadLocalPackages(ctx, treeModDir, patterns, buildCfg, allowErrors)
+		if err != nil {
+			return nil, err
+		}
+		graphs = append(graphs, pkgs)
+	}
+	return mergeGraphs(graphs), nil
+}
+
+// describe the packages in `pkgs` by import path, excluding test variants,
+// with directories relative to `treeDir`.
+func describePackages(pkgs []*packages.Package, treeDir string) map[string]Package {
+	testBinaries := getTestBinaries(pkgs)
+	described := make(map[string]Package, len(pkgs))
+	for _, pkg := range pkgs {
+		pkgPath := basePkgPath(pkg.ID, testBinaries)
+		if pkg.ID != pkgPath {
+			// a test variant or binary, with the same directory as the
+			// package itself
+			continue
+		}
+		dir, err := filepath.Rel(treeDir, pkg.Dir)
+		if err != nil { //go-cov:skip // both paths are absolute, so we don't expect a failure
+			dir = pkg.Dir
+		}
+		described[pkgPath] = Package{PkgPath: pkgPath, Name: pkg.Name, Dir: dir}
+	}
+	return described
+}
+
+// fill in the details of each package in `changed` from `pkgs`, and split out
+// those that no longer exist, which are described by `oldPkgs` instead.
+// Packages not in `oldPkgs` are added, unless it's nil.
+func classifyPackages(
+	changed []Package,
+	pkgs map[string]Package,
+	oldPkgs map[string]Package,
+) ([]Package, []Package) {
+	var removed []Package
+	changed = slices.DeleteFunc(changed, func(pkg Package) bool {
+		if _, ok := pkgs[pkg.PkgPath]; !ok {
+			pkg.Name = oldPkgs[pkg.PkgPath].Name
+			pkg.Dir = oldPkgs[pkg.PkgPath].Dir
+			pkg.Status = StatusRemoved
+			removed = append(removed, pkg)
+			return true
+		}
+		return false
+	})
+	for i, pkg := range changed {
+		changed[i].Name = pkgs[pkg.PkgPath].Name
+		changed[i].Dir = pkgs[pkg.PkgPath].Dir
+		changed[i].Status = StatusModified
+		if _, ok := oldPkgs[pkg.PkgPath]; oldPkgs != nil && !ok {
+			changed[i].Status = StatusAdded
+		}
+	}
+	return changed, removed
+}
+
+// get the ID of the package a change to `path` is attributed to, if it's one
+// of the files of `pkg`.
+func fileOwner(pkg *packages.Package, treeDir string, path string) (string, bool) {
+	// packages.Package uses absolute paths for files
+	absPath := filepath.Join(treeDir, path)
+
+	if slices.Contains(pkg.GoFiles, absPath) ||
+		slices.Contains(pkg.OtherFiles, absPath) ||
+		slices.Contains(pkg.EmbedFiles, absPath) {
+		return pkg.ID, true
+	}
+	// files excluded by build constraints still belong to the package, in
+	// some other build configuration
+	if !slices.Contains(pkg.IgnoredFiles, absPath) {
+		return "", false
+	}
+	if strings.HasSuffix(path, "_test.go") && pkg.ID == pkg.PkgPath {
+		// test files are listed as ignored by the package itself, rather
+		// than a test variant, which may not exist if the package has no
+		// other tests. So attribute them to the test variant regardless, to
+		// only affect the package's tests
+		return pkg.PkgPath + " [" + pkg.PkgPath + ".test]", true
+	}
+	return pkg.ID, true
+}
+
+// get the 3rd party packages imported, directly or indirectly, by `pkgs` that
+// are changed because either they, or any package they import, belong to a
+// module in `changedMods`. Returns a map of package ID to the changed module
+// it depends on.
+func getChangedDeps(
+	ctx context.Context,
+	pkgs []*packages.Package,
+	changedMods map[string]struct{},
+) map[string]string {
+	changedDeps := map[string]string{}
+	if len(changedMods) == 0 {
+		return changedDeps
+	}
+
+	// post-order, so a package's imports are always visited before it
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		modPath := _stdModule
+		if pkg.Module != nil {
+			if pkg.Module.Main {
+				// local package
+				return
+			}
+			modPath = pkg.Module.Path
+		}
+		if _, ok := changedMods[modPath]; ok {
+			changedDeps[pkg.ID] = modPath
+			return
+		}
+		for _, importPkg := range pkg.Imports {
+			if mod, ok := changedDeps[importPkg.ID]; ok {
+				slogctx.FromContext(ctx).Debug(
+					"3rd party package detected changed because of dependent 3rd party module",
+					"package",
+					pkg.ID,
+					"module",
+					mod,
+				)
+				changedDeps[pkg.ID] = mod
+				return
+			}
+		}
+	})
+
+	return changedDeps
+}
+
+// get the reasons, if any, that the package with the given ID is changed
+// because of what it imports.
+func getImportChanges(
+	ctx context.Context,
+	pkgID string,
+	imports map[string]*packages.Package,
+	changedDeps map[string]string,
+	changedPackages map[string]*Reasons,
+) Reasons {
+	var reasons Reasons
+	for _, importPkg := range imports {
+		if _, ok := changedPackages[importPkg.ID]; ok {
+			slogctx.FromContext(ctx).Debug(
+				"package detected changed because of dependent package",
+				"package",
+				pkgID,
+				"dependency",
+				importPkg.ID,
+			)
+			reasons.Dependencies = append(reasons.Dependencies, importPkg.ID)
+		}
+		if mod, ok := changedDeps[importPkg.ID]; ok {
+			slogctx.FromContext(ctx).Debug(
+				"package detected changed because of dependent 3rd party module",
+				"package",
+				pkgID,
+				"dependency",
+				importPkg.ID,
+				"module",
+				mod,
+			)
+			reasons.Modules = append(reasons.Modules, mod)
+		}
+	}
+	return reasons
+}
@@ -0,0 +1,2311 @@
+package changedpkgs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+	"gopkg.in/yaml.v3"
+
+	"github.com/utilitywarehouse/go-changed-pkgs/internal/testrepo"
+)
+
+// path to the test module.
+var modPath = filepath.Join("changedpkgs", "testdata", "repo")
+
+// the name of the test module.
+const testModuleName = "example.com/test-repo"
+
+// the import path of the test module as part of this repo's module.
+const repoModPath = "github.com/utilitywarehouse/go-changed-pkgs/changedpkgs/testdata/repo"
+
+// map of patch name -> expected changed packages.
+type testCfg map[string][]string
+
+// some of these tests run based off testdata containing:
+//
+//   - a test module with some basic Go files
+//   - a set of patches to be applied to the files in this module,
+//     and the expected changed outout
+//
+// load these configs from: testdata/repo/patches/config.yaml.
+func loadTestConfigs(t *testing.T) testCfg {
+	t.Helper()
+	configPath := testrepo.PatchPath(t, "repo", "config.yaml")
+	data, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+
+	configs := make(testCfg)
+	require.NoError(t, yaml.Unmarshal(data, &configs))
+
+	for name, expectedRelPkgs := range configs {
+		// for simplicity, config.yaml just contains relative package paths,
+		// so add back the module name to these to get complete package paths
+		configs[name] = addModuleName(expectedRelPkgs)
+	}
+
+	return configs
+}
+
+// commit the patches to the test module in the worktree, and get the changes
+// they make. Only the refs and directories in `opts` are overridden.
+func getWithPatches(
+	t *testing.T,
+	worktreePath string,
+	patchNames []string,
+	opts Options,
+) (Result, error) {
+	t.Helper()
+	return getModuleWithPatches(t, worktreePath, "repo", patchNames, opts)
+}
+
+// like getWithPatches, but for the test module `module`, as for
+// [testrepo.ModDir].
+func getModuleWithPatches(
+	t *testing.T,
+	worktreePath string,
+	module string,
+	patchNames []string,
+	opts Options,
+) (Result, error) {
+	t.Helper()
+	prePatchHead, postPatchHead := testrepo.CommitModulePatches(t, worktreePath, module, patchNames...)
+
+	opts.RepoDir = worktreePath
+	opts.ModDir = testrepo.ModDir(worktreePath, module)
+	opts.FromRef = prePatchHead
+	opts.ToRef = postPatchHead
+	return Get(context.Background(), opts)
+}
+
+func TestWithSingleCommit(t *testing.T) {
+	t.Parallel()
+	configs := loadTestConfigs(t)
+
+	for name, expected := range configs {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := getWithPatches(t, testrepo.SetupWorktree(t), []string{name}, Options{})
+
+			require.NoError(t, err)
+			compareResults(t, expected, result)
+		})
+	}
+}
+
+func TestTestDependencies(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		patch string
+		opts  Options
+		// map of changed package -> whether only its tests are affected
+		expected map[string]bool
+	}{
+		{
+			name:     "test imports ignored by default",
+			patch:    "change-in-embedded-file.patch",
+			expected: map[string]bool{"/internal/sql": false, "/cmd/db": false},
+		},
+		{
+			name:  "test imports included",
+			patch: "change-in-embedded-file.patch",
+			opts:  Options{IncludeTestDeps: true},
+			expected: map[string]bool{
+				"/internal/sql":      false,
+				"/cmd/db":            false,
+				"/internal/consumer": true,
+			},
+		},
+		{
+			name:     "test file change only affects tests",
+			patch:    "change-in-test-file.patch",
+			expected: map[string]bool{"/internal/utils": true},
+		},
+		{
+			// and not cmd/db, which imports it
+			name:     "test file excluded by build constraints only affects tests",
+			patch:    "change-in-ignored-test-file.patch",
+			expected: map[string]bool{"/internal/sql": true},
+		},
+		{
+			name:     "test file built with tags only affects tests",
+			patch:    "change-in-ignored-test-file.patch",
+			opts:     Options{Tags: []string{"integration"}},
+			expected: map[string]bool{"/internal/sql": true},
+		},
+		{
+			name:     "deleted test file only affects tests",
+			patch:    "remove-test-file.patch",
+			expected: map[string]bool{"/internal/utils": true},
+		},
+		{
+			name:     "external test file change only affects tests",
+			patch:    "change-in-external-test-file.patch",
+			expected: map[string]bool{"/internal/consumer": true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleNameToKeys(tc.expected)
+
+			result, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				tc.opts,
+			)
+			require.NoError(t, err)
+
+			actual := make(map[string]bool, len(result.Packages))
+			for _, pkg := range result.Packages {
+				actual[pkg.PkgPath] = pkg.TestsOnly
+			}
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestReasons(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		patch    string
+		opts     Options
+		expected []Package
+	}{
+		{
+			name:  "changed file and dependencies",
+			patch: "change-in-embedded-file.patch",
+			opts:  Options{IncludeTestDeps: true},
+			expected: []Package{
+				{
+					PkgPath: "/internal/sql",
+					Reasons: Reasons{
+						Files: []string{"changedpkgs/testdata/repo/internal/sql/migration.sql"},
+					},
+				},
+				{
+					PkgPath: "/cmd/db",
+					Reasons: Reasons{Dependencies: []string{"/internal/sql"}},
+				},
+				{
+					PkgPath:   "/internal/consumer",
+					TestsOnly: true,
+					Reasons:   Reasons{Dependencies: []string{"/internal/sql"}},
+				},
+			},
+		},
+		{
+			name:  "changed embed pattern",
+			patch: "change-embed-pattern.patch",
+			expected: []Package{
+				{
+					PkgPath: "/internal/sql",
+					Reasons: Reasons{
+						Files: []string{
+							"changedpkgs/testdata/repo/internal/sql/driver.c",
+							"changedpkgs/testdata/repo/internal/sql/migration.sql",
+							"changedpkgs/testdata/repo/internal/sql/sql.go",
+						},
+					},
+				},
+				{
+					PkgPath: "/cmd/db",
+					Reasons: Reasons{Dependencies: []string{"/internal/sql"}},
+				},
+			},
+		},
+		{
+			name:  "added embedded file",
+			patch: "add-embedded-file.patch",
+			expected: []Package{
+				{
+					PkgPath: "/internal/sql",
+					Reasons: Reasons{
+						Files: []string{"changedpkgs/testdata/repo/internal/sql/seed.sql"},
+					},
+				},
+				{
+					PkgPath: "/cmd/db",
+					Reasons: Reasons{Dependencies: []string{"/internal/sql"}},
+				},
+			},
+		},
+		{
+			name:  "changed module",
+			patch: "upgrade-first-level-dependency.patch",
+			expected: []Package{
+				{
+					PkgPath: "/internal/consumer",
+					Reasons: Reasons{Modules: []string{"golang.org/x/sys"}},
+				},
+				{
+					PkgPath: "",
+					Reasons: Reasons{Dependencies: []string{"/internal/consumer"}},
+				},
+				{
+					PkgPath: "/cmd/db",
+					Reasons: Reasons{Modules: []string{"golang.org/x/sys"}},
+				},
+			},
+		},
+		{
+			name:  "changed go version",
+			patch: "bump-go-version.patch",
+			expected: []Package{
+				{
+					PkgPath: "/internal/sql",
+					Reasons: Reasons{Modules: []string{_stdModule}},
+				},
+				{
+					PkgPath: "/cmd/db",
+					Reasons: Reasons{
+						Modules:      []string{_stdModule},
+						Dependencies: []string{"/internal/sql"},
+					},
+				},
+				{
+					PkgPath: "/internal/utils",
+					Reasons: Reasons{Modules: []string{_stdModule}},
+				},
+				{
+					PkgPath: "/internal/consumer",
+					Reasons: Reasons{
+						Modules:      []string{_stdModule},
+						Dependencies: []string{"/internal/utils"},
+					},
+				},
+				{
+					PkgPath: "",
+					Reasons: Reasons{
+						Modules:      []string{_stdModule},
+						Dependencies: []string{"/internal/consumer"},
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := make([]Package, 0, len(tc.expected))
+			for _, pkg := range tc.expected {
+				pkg.Name, pkg.Dir = describeTestPackage(pkg.PkgPath)
+				pkg.PkgPath = testModuleName + pkg.PkgPath
+				// none of these patches add or remove packages
+				pkg.Status = StatusModified
+				for i, dep := range pkg.Reasons.Dependencies {
+					pkg.Reasons.Dependencies[i] = testModuleName + dep
+				}
+				expected = append(expected, pkg)
+			}
+
+			result, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				tc.opts,
+			)
+
+			require.NoError(t, err)
+			require.ElementsMatch(t, expected, result.Packages)
+		})
+	}
+}
+
+func TestWhy(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		patch    string
+		opts     Options
+		pkgPath  string
+		expected Chain
+	}{
+		{
+			name:    "changed file",
+			patch:   "change-in-embedded-file.patch",
+			pkgPath: "/cmd/db",
+			expected: Chain{
+				Packages: []string{"/cmd/db", "/internal/sql"},
+				File:     "changedpkgs/testdata/repo/internal/sql/migration.sql",
+			},
+		},
+		{
+			name:    "changed module",
+			patch:   "upgrade-first-level-dependency.patch",
+			pkgPath: "",
+			expected: Chain{
+				Packages: []string{"", "/internal/consumer"},
+				Module:   "golang.org/x/sys",
+			},
+		},
+		{
+			name:    "indirect change",
+			patch:   "change-in-second-level-package.patch",
+			pkgPath: "",
+			expected: Chain{
+				Packages: []string{"", "/internal/consumer", "/internal/utils"},
+				File:     "changedpkgs/testdata/repo/internal/utils/files.go",
+			},
+		},
+		{
+			name:    "through excluded packages",
+			patch:   "change-in-second-level-package.patch",
+			opts:    Options{Exclude: []string{"./internal/..."}},
+			pkgPath: "",
+			expected: Chain{
+				Packages: []string{"", "/internal/consumer", "/internal/utils"},
+				File:     "changedpkgs/testdata/repo/internal/utils/files.go",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			tc.expected.Packages = addModuleName(tc.expected.Packages)
+
+			result, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				tc.opts,
+			)
+			require.NoError(t, err)
+
+			chain, ok := result.Why(testModuleName + tc.pkgPath)
+			require.True(t, ok)
+			require.Equal(t, tc.expected, chain)
+		})
+	}
+}
+
+func TestWhyUnchangedPackage(t *testing.T) {
+	t.Parallel()
+
+	result, err := getWithPatches(
+		t,
+		testrepo.SetupWorktree(t),
+		[]string{"change-in-embedded-file.patch"},
+		Options{},
+	)
+	require.NoError(t, err)
+
+	_, ok := result.Why(testModuleName + "/internal/utils")
+	require.False(t, ok)
+}
+
+func TestWhyAddedPackage(t *testing.T) {
+	t.Parallel()
+
+	result, err := getWithPatches(
+		t,
+		testrepo.SetupWorktree(t),
+		[]string{"remove-go-mod.patch"},
+		Options{},
+	)
+	require.NoError(t, err)
+
+	// none of its files changed, but it's now part of this repo's module
+	chain, ok := result.Why(repoModPath + "/cmd/db")
+	require.True(t, ok)
+	require.Equal(
+		t,
+		Chain{
+			Packages: []string{repoModPath + "/cmd/db"},
+			File:     "changedpkgs/testdata/repo/go.mod",
+		},
+		chain,
+	)
+}
+
+func TestWhyShortestChain(t *testing.T) {
+	t.Parallel()
+
+	result, err := getWorkspaceWithPatches(
+		t,
+		testrepo.SetupWorktree(t),
+		[]string{"change-in-lib.patch"},
+		Options{},
+	)
+	require.NoError(t, err)
+
+	chain, ok := result.Why("example.com/app")
+	require.True(t, ok)
+	// example.com/app also imports example.com/lib through example.com/app/cli
+	require.Equal(
+		t,
+		Chain{
+			Packages: []string{"example.com/app", "example.com/lib"},
+			File:     "changedpkgs/testdata/workspace/lib/lib.go",
+		},
+		chain,
+	)
+}
+
+func TestToShaNotHead(t *testing.T) {
+	t.Parallel()
+	configs := loadTestConfigs(t)
+
+	// for simplicity: patches with non-intersecting expected changed files
+	patchesForCommit := []string{
+		"change-in-top-level-package.patch",
+		"change-in-embedded-file.patch",
+	}
+
+	expected := []string{}
+	for _, name := range patchesForCommit {
+		expected = append(expected, configs[name]...)
+	}
+
+	worktreePath := testrepo.SetupWorktree(t)
+	modDir := filepath.Join(worktreePath, modPath)
+	prePatchHead, postPatchHead := testrepo.CommitModulePatches(t, worktreePath, "repo", patchesForCommit...)
+
+	// add extra commit so HEAD != toSHA
+	testrepo.CommitModulePatches(t, worktreePath, "repo", "upgrade-top-level-dependency.patch")
+
+	result, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		ModDir:  modDir,
+		FromRef: prePatchHead,
+		ToRef:   postPatchHead,
+	})
+	require.NoError(t, err)
+	compareResults(t, expected, result)
+}
+
+func TestWorkingTree(t *testing.T) {
+	t.Parallel()
+	utilsDir := filepath.Join(modPath, "internal", "utils")
+
+	for _, tc := range []struct {
+		name string
+		// make changes in the worktree, without committing them
+		setup    func(t *testing.T, worktreePath string)
+		opts     Options
+		expected []string
+	}{
+		{
+			name: "unstaged change",
+			setup: func(t *testing.T, worktreePath string) {
+				t.Helper()
+				applyPatch(t, worktreePath, "change-in-top-level-package.patch")
+			},
+			expected: []string{""},
+		},
+		{
+			name: "untracked file",
+			setup: func(t *testing.T, worktreePath string) {
+				t.Helper()
+				require.NoError(t, os.WriteFile(
+					filepath.Join(worktreePath, utilsDir, "new.go"),
+					[]byte("package utils\n"),
+					0o600,
+				))
+			},
+			expected: []string{"/internal/utils", "/internal/consumer", ""},
+		},
+		{
+			name: "deleted file",
+			setup: func(t *testing.T, worktreePath string) {
+				t.Helper()
+				require.NoError(t, os.Remove(filepath.Join(worktreePath, utilsDir, "files_test.go")))
+			},
+			expected: []string{"/internal/utils"},
+		},
+		{
+			name: "staged change",
+			setup: func(t *testing.T, worktreePath string) {
+				t.Helper()
+				applyPatch(t, worktreePath, "change-in-embedded-file.patch", "--index")
+				applyPatch(t, worktreePath, "change-in-top-level-package.patch")
+			},
+			opts:     Options{Staged: true},
+			expected: []string{"/internal/sql", "/cmd/db"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleName(tc.expected)
+			worktreePath := testrepo.SetupWorktree(t)
+			tc.setup(t, worktreePath)
+
+			opts := tc.opts
+			opts.RepoDir = worktreePath
+			opts.ModDir = filepath.Join(worktreePath, modPath)
+			opts.FromRef = "HEAD"
+			result, err := Get(context.Background(), opts)
+
+			require.NoError(t, err)
+			compareResults(t, expected, result)
+		})
+	}
+}
+
+func TestErrorsWhenComparingAgainstRefAndIndex(t *testing.T) {
+	t.Parallel()
+
+	_, err := Get(context.Background(), Options{FromRef: "HEAD~", ToRef: "HEAD", Staged: true})
+
+	require.EqualError(t, err, "can't compare against both HEAD and the index")
+}
+
+func TestErrorsWhenFailingToParseGoModInWorkingTree(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		opts        Options
+		expectedErr string
+	}{
+		{
+			name:        "working tree",
+			expectedErr: "at the working tree: ",
+		},
+		{
+			name:        "index",
+			opts:        Options{Staged: true},
+			expectedErr: "at the index: ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			worktreePath := testrepo.SetupWorktree(t)
+			// the module isn't used by the one we load packages from, so the
+			// go command doesn't notice it's broken
+			goModPath := filepath.Join("changedpkgs", "testdata", "replace", "lib2", "go.mod")
+			require.NoError(t, os.WriteFile(filepath.Join(worktreePath, goModPath), []byte("not a go.mod\n"), 0o600))
+			mustRunGitCmd(t, "-C", worktreePath, "add", goModPath)
+
+			opts := tc.opts
+			opts.RepoDir = worktreePath
+			opts.ModDir = testrepo.ModDir(worktreePath, "replace/app")
+			opts.FromRef = "HEAD"
+			_, err := Get(context.Background(), opts)
+
+			require.ErrorContains(t, err, "parsing mod file "+goModPath+" "+tc.expectedErr)
+		})
+	}
+}
+
+func TestErrorsWhenFailingToReadIndex(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+	indexPath := mustRunGitCmd(t, "-C", worktreePath, "rev-parse", "--path-format=absolute", "--git-path", "index")
+	require.NoError(t, os.Remove(strings.TrimSpace(indexPath)))
+
+	_, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		ModDir:  filepath.Join(worktreePath, modPath),
+		FromRef: "HEAD",
+		Staged:  true,
+	})
+
+	require.ErrorContains(t, err, "reading index: ")
+}
+
+func TestMergeBase(t *testing.T) {
+	t.Parallel()
+	configs := loadTestConfigs(t)
+	branchPatch := "change-in-top-level-package.patch"
+	mainPatch := "change-in-embedded-file.patch"
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		// whether to compare against the branch's tip, rather than the
+		// working tree
+		useToRef bool
+		expected []string
+	}{
+		{
+			name:     "without merge base",
+			useToRef: true,
+			expected: append(slices.Clone(configs[branchPatch]), configs[mainPatch]...),
+		},
+		{
+			name:     "with merge base",
+			opts:     Options{MergeBase: true},
+			useToRef: true,
+			expected: configs[branchPatch],
+		},
+		{
+			name:     "with merge base against the working tree",
+			opts:     Options{MergeBase: true},
+			expected: configs[branchPatch],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			worktreePath := testrepo.SetupWorktree(t)
+			// main moves on after the branch forked
+			forkPoint, mainTip := testrepo.CommitModulePatches(t, worktreePath, "repo", mainPatch)
+			mustRunGitCmd(t, "-C", worktreePath, "checkout", "--quiet", "--detach", forkPoint)
+			_, branchTip := testrepo.CommitModulePatches(t, worktreePath, "repo", branchPatch)
+
+			opts := tc.opts
+			opts.RepoDir = worktreePath
+			opts.ModDir = filepath.Join(worktreePath, modPath)
+			opts.FromRef = mainTip
+			if tc.useToRef {
+				opts.ToRef = branchTip
+			}
+			result, err := Get(context.Background(), opts)
+
+			require.NoError(t, err)
+			compareResults(t, tc.expected, result)
+		})
+	}
+}
+
+func TestErrorsWhenFailingToFindMergeBase(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+
+	_, err := Get(context.Background(), Options{
+		RepoDir:   worktreePath,
+		ModDir:    filepath.Join(worktreePath, modPath),
+		FromRef:   "does-not-exist",
+		ToRef:     "HEAD",
+		MergeBase: true,
+	})
+
+	require.ErrorContains(t, err, "finding merge base of does-not-exist and HEAD: ")
+}
+
+func TestRelativeRepoAndModDirs(t *testing.T) {
+	t.Parallel()
+	configs := loadTestConfigs(t)
+	patchName := "change-in-top-level-package.patch"
+	expected := configs[patchName]
+
+	absWorktreePath := testrepo.SetupWorktree(t)
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	worktreePath, err := filepath.Rel(cwd, absWorktreePath)
+	require.NoError(t, err)
+	modDir := filepath.Join(worktreePath, modPath)
+
+	prePatchHead, postPatchHead := testrepo.CommitModulePatches(t, worktreePath, "repo", patchName)
+
+	result, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		ModDir:  modDir,
+		FromRef: prePatchHead,
+		ToRef:   postPatchHead,
+	})
+	require.NoError(t, err)
+	compareResults(t, expected, result)
+}
+
+func TestWorkspace(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		patches  []string
+		opts     Options
+		expected []string
+	}{
+		{
+			name:     "change in module imported by another",
+			patches:  []string{"change-in-lib.patch"},
+			expected: []string{"example.com/lib", "example.com/app/cli", "example.com/app"},
+		},
+		{
+			name:     "without go.work",
+			patches:  []string{"remove-go-work.patch", "change-in-lib.patch"},
+			expected: []string{"example.com/lib", "example.com/app/cli", "example.com/app"},
+		},
+		{
+			// the build list is listed in the workspace, at both versions
+			name:     "go.mod changed in module requiring another",
+			patches:  []string{"comment-app-go-mod.patch"},
+			expected: []string{},
+		},
+		{
+			name:     "go.mod changed without go.work",
+			patches:  []string{"remove-go-work.patch", "comment-app-go-mod.patch"},
+			expected: []string{},
+		},
+		{
+			name:     "new module",
+			patches:  []string{"add-module.patch"},
+			expected: []string{"example.com/tool"},
+		},
+		{
+			name:    "toolchain changed",
+			patches: []string{"add-work-toolchain.patch"},
+			expected: []string{
+				"example.com/lib",
+				"example.com/lib/strs",
+				"example.com/app/cli",
+				"example.com/app",
+			},
+		},
+		{
+			name:     "toolchain changed only affecting stdlib importers",
+			patches:  []string{"add-work-toolchain.patch"},
+			opts:     Options{GoVersionChanges: GoVersionChangesStdlib},
+			expected: []string{"example.com/lib/strs"},
+		},
+		{
+			name:     "toolchain changed ignored",
+			patches:  []string{"add-work-toolchain.patch"},
+			opts:     Options{GoVersionChanges: GoVersionChangesNone},
+			expected: []string{},
+		},
+		{
+			// lib doesn't import app, so is built just the same
+			name:     "module go version changed",
+			patches:  []string{"change-app-go-version.patch"},
+			expected: []string{"example.com/app/cli", "example.com/app"},
+		},
+		{
+			// the go command uses the toolchain of the workspace instead
+			name:     "module toolchain changed",
+			patches:  []string{"add-toolchain.patch"},
+			expected: []string{},
+		},
+		{
+			name:    "module toolchain changed without go.work",
+			patches: []string{"remove-go-work.patch", "add-toolchain.patch"},
+			// the workspace created to load the modules isn't used to
+			// build them
+			expected: []string{
+				"example.com/lib",
+				"example.com/lib/strs",
+				"example.com/app/cli",
+				"example.com/app",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := getWorkspaceWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				tc.patches,
+				tc.opts,
+			)
+
+			require.NoError(t, err)
+			compareResults(t, tc.expected, result)
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		order    Order
+		expected []string
+	}{
+		{
+			name:     "lexical by default",
+			expected: []string{"example.com/app", "example.com/app/cli", "example.com/lib"},
+		},
+		{
+			name:     "lexical",
+			order:    OrderLexical,
+			expected: []string{"example.com/app", "example.com/app/cli", "example.com/lib"},
+		},
+		{
+			name:     "topological",
+			order:    OrderTopological,
+			expected: []string{"example.com/lib", "example.com/app/cli", "example.com/app"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := getWorkspaceWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{"change-in-lib.patch"},
+				Options{Order: tc.order},
+			)
+			require.NoError(t, err)
+
+			actual := make([]string, 0, len(result.Packages))
+			for _, pkg := range result.Packages {
+				actual = append(actual, pkg.PkgPath)
+			}
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestWorkspaceErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		patches     []string
+		expectedErr string
+	}{
+		{
+			name:        "invalid go.work",
+			patches:     []string{"break-go-work.patch"},
+			expectedErr: "parsing workspace file ",
+		},
+		{
+			name:        "invalid go.mod without go.work",
+			patches:     []string{"remove-go-work.patch", "break-lib-go-mod.patch"},
+			expectedErr: "creating workspace in ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := getWorkspaceWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				tc.patches,
+				Options{},
+			)
+
+			require.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestWorkspaceWithErrorsBeforeChange(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+	// the workspace can't be loaded before the change, as it uses a module
+	// that doesn't exist...
+	_, headSha := testrepo.CommitModulePatches(t, worktreePath, "workspace", "use-tool-module.patch")
+	// ...until the change adds it
+	mustRunGitCmd(
+		t,
+		"-C",
+		worktreePath,
+		"apply",
+		"--index",
+		"--exclude=changedpkgs/testdata/workspace/go.work",
+		testrepo.PatchPath(t, "workspace", "add-module.patch"),
+	)
+
+	result, err := Get(context.Background(), Options{
+		RepoDir:   worktreePath,
+		ModDir:    testrepo.ModDir(worktreePath, "workspace"),
+		FromRef:   headSha,
+		Staged:    true,
+		Workspace: true,
+	})
+
+	require.NoError(t, err)
+	compareResults(t, []string{"example.com/tool"}, result)
+}
+
+// not parallel, as it sets the environment
+func TestWorkspaceIgnoresModFlag(t *testing.T) {
+	// `-mod=mod` is rejected in workspace mode
+	t.Setenv("GOFLAGS", "-mod=mod")
+
+	result, err := getWorkspaceWithPatches(
+		t,
+		testrepo.SetupWorktree(t),
+		[]string{"change-in-lib.patch"},
+		Options{},
+	)
+
+	require.NoError(t, err)
+	compareResults(t, []string{"example.com/lib", "example.com/app/cli", "example.com/app"}, result)
+}
+
+func TestGoEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		goFlags  string
+		expected string
+	}{
+		{
+			name:     "without mod flag",
+			goFlags:  "-tags=integration",
+			expected: "-tags=integration",
+		},
+		{
+			name:     "with mod flags",
+			goFlags:  "-mod=mod -tags=integration --mod=vendor",
+			expected: "-tags=integration",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("GOFLAGS", tc.goFlags)
+
+			env := goEnv()
+
+			// like the go command, the last value wins
+			var goFlags string
+			for _, kv := range env {
+				if value, ok := strings.CutPrefix(kv, "GOFLAGS="); ok {
+					goFlags = value
+				}
+			}
+			require.Equal(t, tc.expected, goFlags)
+		})
+	}
+}
+
+func TestWorkspaceErrorsWhenDisabled(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		goWork   string
+		expected string
+	}{
+		{
+			name:     "GOWORK off",
+			goWork:   "off",
+			expected: "can't load a workspace with GOWORK=off",
+		},
+		{
+			name:     "GOWORK missing",
+			goWork:   filepath.Join(t.TempDir(), "go.work"),
+			expected: "reading workspace file ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("GOWORK", tc.goWork)
+
+			_, err := getWorkspaceWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{"change-in-lib.patch"},
+				Options{},
+			)
+
+			require.ErrorContains(t, err, tc.expected)
+		})
+	}
+}
+
+func TestWorkspaceErrorsWithoutModules(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+
+	_, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		// contains no modules outside of testdata, and isn't part of a
+		// workspace
+		ModDir:    filepath.Join(worktreePath, "changedpkgs"),
+		FromRef:   "HEAD",
+		ToRef:     "HEAD",
+		Workspace: true,
+	})
+
+	require.ErrorContains(t, err, "no modules found under ")
+}
+
+func TestLocalReplacements(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		patches  []string
+		expected []string
+	}{
+		{
+			name:     "change in replacement",
+			patches:  []string{"change-in-replaced-module.patch"},
+			expected: []string{"example.com/app"},
+		},
+		{
+			name:     "change in unused replacement",
+			patches:  []string{"change-in-unused-replacement.patch"},
+			expected: []string{},
+		},
+		{
+			name:     "replacement retargeted",
+			patches:  []string{"retarget-replacement.patch"},
+			expected: []string{"example.com/app"},
+		},
+		{
+			name:     "replacement limited to a version",
+			patches:  []string{"replace-version.patch"},
+			expected: []string{"example.com/app"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := getModuleWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				"replace/app",
+				tc.patches,
+				Options{},
+			)
+
+			require.NoError(t, err)
+			compareResults(t, tc.expected, result)
+		})
+	}
+}
+
+func TestBuildListChanges(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		// patches committed before the change
+		basePatches []string
+		patches     []string
+		expected    []string
+	}{
+		{
+			// only golang.org/x/term is required, but the new requirement
+			// raises the version of golang.org/x/sys, which it imports
+			name:     "new requirement",
+			patches:  []string{"add-requirement.patch"},
+			expected: []string{"example.com/app"},
+		},
+		{
+			// the replacement is resolved relative to the go.mod at each
+			// version
+			name:        "fixed replacement",
+			basePatches: []string{"break-requirement.patch"},
+			patches:     []string{"fix-requirement.patch"},
+			expected:    []string{},
+		},
+		{
+			// the go command can't list the build list, so only the
+			// requirements are compared
+			name:        "fixed go.mod",
+			basePatches: []string{"add-unknown-godebug.patch"},
+			patches:     []string{"remove-unknown-godebug.patch"},
+			expected:    []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			worktreePath := testrepo.SetupWorktree(t)
+			for _, patch := range tc.basePatches {
+				testrepo.CommitModulePatches(t, worktreePath, "unpruned", patch)
+			}
+
+			result, err := getModuleWithPatches(
+				t,
+				worktreePath,
+				"unpruned/app",
+				tc.patches,
+				Options{},
+			)
+
+			require.NoError(t, err)
+			compareResults(t, tc.expected, result)
+		})
+	}
+}
+
+func TestGoVersionAdded(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+	// start from a go.mod without any go version
+	testrepo.CommitModulePatches(t, worktreePath, "replace", "remove-go-version.patch")
+
+	result, err := getModuleWithPatches(
+		t,
+		worktreePath,
+		"replace/app",
+		[]string{"add-go-version.patch"},
+		Options{},
+	)
+
+	require.NoError(t, err)
+	compareResults(t, []string{"example.com/app", "example.com/app/other"}, result)
+}
+
+// like getWithPatches, but for the workspace under testdata/workspace.
+func getWorkspaceWithPatches(
+	t *testing.T,
+	worktreePath string,
+	patchNames []string,
+	opts Options,
+) (Result, error) {
+	t.Helper()
+	opts.Workspace = true
+	return getModuleWithPatches(t, worktreePath, "workspace", patchNames, opts)
+}
+
+// get the name and directory of the package in the test module with the
+// given relative package path.
+func describeTestPackage(relPkgPath string) (string, string) {
+	dir := filepath.Join(modPath, filepath.FromSlash(relPkgPath))
+	if relPkgPath == "" || relPkgPath == "/cmd/db" {
+		return "main", dir
+	}
+	return filepath.Base(dir), dir
+}
+
+func compareResults(t *testing.T, expected []string, result Result) {
+	t.Helper()
+	pkgPaths := make([]string, 0, len(result.Packages))
+	for _, pkg := range result.Packages {
+		pkgPaths = append(pkgPaths, pkg.PkgPath)
+	}
+
+	require.ElementsMatch(t, expected, pkgPaths)
+}
+
+// add the test module's name to the relative package paths in `pkgs`, which
+// are empty or start with "/". Other package paths are left as they are.
+func addModuleName(pkgs []string) []string {
+	named := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		named = append(named, withModuleName(pkg))
+	}
+	return named
+}
+
+// like addModuleName, but for the keys of `pkgs`.
+func addModuleNameToKeys[V any](pkgs map[string]V) map[string]V {
+	named := make(map[string]V, len(pkgs))
+	for pkg, value := range pkgs {
+		named[withModuleName(pkg)] = value
+	}
+	return named
+}
+
+func withModuleName(pkg string) string {
+	if pkg != "" && !strings.HasPrefix(pkg, "/") {
+		return pkg
+	}
+	return testModuleName + pkg
+}
+
+// apply the patch to the worktree without committing it.
+func applyPatch(t *testing.T, worktreePath string, patchName string, extraArgs ...string) {
+	t.Helper()
+	args := append([]string{"-C", worktreePath, "apply"}, extraArgs...)
+	mustRunGitCmd(t, append(args, testrepo.PatchPath(t, "repo", patchName))...)
+}
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		patch string
+		opts  Options
+		// map of changed or removed package -> its status
+		expected map[string]Status
+	}{
+		{
+			name:     "modified package",
+			patch:    "change-in-top-level-package.patch",
+			expected: map[string]Status{"": StatusModified},
+		},
+		{
+			name:  "renamed package",
+			patch: "rename-package.patch",
+			expected: map[string]Status{
+				"/cmd/migrate": StatusAdded,
+				"/cmd/db":      StatusRemoved,
+			},
+		},
+		{
+			name:     "selected added package",
+			patch:    "rename-package.patch",
+			opts:     Options{Patterns: []string{"./cmd/migrate/..."}},
+			expected: map[string]Status{"/cmd/migrate": StatusAdded},
+		},
+		{
+			name:     "selected added package directory",
+			patch:    "rename-package.patch",
+			opts:     Options{Patterns: []string{"./cmd/migrate"}},
+			expected: map[string]Status{"/cmd/migrate": StatusAdded},
+		},
+		{
+			name:     "selected added package import path",
+			patch:    "rename-package.patch",
+			opts:     Options{Patterns: []string{testModuleName + "/cmd/migrate"}},
+			expected: map[string]Status{"/cmd/migrate": StatusAdded},
+		},
+		{
+			name:  "package moved to new module",
+			patch: "split-module.patch",
+			// its files haven't changed, but it's no longer part of the module
+			expected: map[string]Status{"/cmd/db": StatusRemoved},
+		},
+		{
+			name:  "removed module",
+			patch: "remove-go-mod.patch",
+			// the test module's files are now part of this repo's module
+			expected: map[string]Status{
+				"":                                 StatusRemoved,
+				"/internal/consumer":               StatusRemoved,
+				"/internal/utils":                  StatusRemoved,
+				"/internal/sql":                    StatusRemoved,
+				"/cmd/db":                          StatusRemoved,
+				repoModPath:                        StatusAdded,
+				repoModPath + "/internal/consumer": StatusAdded,
+				repoModPath + "/internal/utils":    StatusAdded,
+				repoModPath + "/internal/sql":      StatusAdded,
+				repoModPath + "/cmd/db":            StatusAdded,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleNameToKeys(tc.expected)
+
+			result, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				tc.opts,
+			)
+			require.NoError(t, err)
+
+			actual := map[string]Status{}
+			for _, pkg := range result.Packages {
+				actual[pkg.PkgPath] = pkg.Status
+			}
+			for _, pkg := range result.Removed {
+				actual[pkg.PkgPath] = pkg.Status
+			}
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		patch           string
+		opts            Options
+		expected        []string
+		expectedRemoved []string
+	}{
+		{
+			name:     "relative pattern",
+			patch:    "bump-go-version.patch",
+			opts:     Options{Patterns: []string{"./cmd/..."}},
+			expected: []string{"/cmd/db"},
+		},
+		{
+			name:     "import path pattern",
+			patch:    "bump-go-version.patch",
+			opts:     Options{Patterns: []string{testModuleName + "/internal/..."}},
+			expected: []string{"/internal/consumer", "/internal/utils", "/internal/sql"},
+		},
+		{
+			name:  "propagates through packages not matched",
+			patch: "change-in-second-level-package.patch",
+			opts:  Options{Patterns: []string{"."}},
+			// via /internal/consumer and /internal/utils
+			expected: []string{""},
+		},
+		{
+			name:  "pattern matching packages of other modules",
+			patch: "bump-go-version.patch",
+			opts:  Options{Patterns: []string{"./cmd/...", "fmt"}},
+			// fmt isn't in the module, even though it uses the standard
+			// library that changed
+			expected: []string{"/cmd/db"},
+		},
+		{
+			name:     "excluded",
+			patch:    "bump-go-version.patch",
+			opts:     Options{Exclude: []string{"./internal/...", testModuleName + "/cmd/db"}},
+			expected: []string{""},
+		},
+		{
+			name:     "propagates through excluded packages",
+			patch:    "change-in-second-level-package.patch",
+			opts:     Options{Exclude: []string{"./internal/..."}},
+			expected: []string{""},
+		},
+		{
+			name:            "removed package",
+			patch:           "rename-package.patch",
+			opts:            Options{Patterns: []string{"./cmd/..."}},
+			expected:        []string{"/cmd/migrate"},
+			expectedRemoved: []string{"/cmd/db"},
+		},
+		{
+			name:     "excluded removed package",
+			patch:    "rename-package.patch",
+			opts:     Options{Exclude: []string{"./cmd/..."}},
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleName(tc.expected)
+			expectedRemoved := addModuleName(tc.expectedRemoved)
+
+			result, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				tc.opts,
+			)
+
+			require.NoError(t, err)
+			compareResults(t, expected, result)
+			compareResults(t, expectedRemoved, Result{Packages: result.Removed})
+		})
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	t.Parallel()
+	readme := filepath.Join(modPath, "README.md")
+
+	for _, tc := range []struct {
+		name     string
+		patch    string
+		triggers []Trigger
+		expected []string
+	}{
+		{
+			name:  "packages",
+			patch: "change-in-unrelated-file.patch",
+			triggers: []Trigger{
+				{Files: []string{"**/*.md"}, Packages: []string{"./cmd/..."}},
+			},
+			expected: []string{"/cmd/db"},
+		},
+		{
+			name:  "all packages",
+			patch: "change-in-unrelated-file.patch",
+			triggers: []Trigger{
+				{Files: []string{readme}, All: true},
+			},
+			expected: []string{"", "/internal/consumer", "/internal/utils", "/internal/sql", "/cmd/db"},
+		},
+		{
+			name:  "deleted file",
+			patch: "remove-readme.patch",
+			triggers: []Trigger{
+				{Files: []string{"changedpkgs/**"}, Packages: []string{testModuleName}},
+			},
+			expected: []string{""},
+		},
+		{
+			name:  "no matching files",
+			patch: "change-in-unrelated-file.patch",
+			triggers: []Trigger{
+				{Files: []string{"*.md"}, All: true},
+				{Files: []string{readme}},
+			},
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleName(tc.expected)
+
+			result, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				Options{Triggers: tc.triggers},
+			)
+
+			require.NoError(t, err)
+			compareResults(t, expected, result)
+			for _, pkg := range result.Packages {
+				require.Equal(t, []string{readme}, pkg.Reasons.Files)
+			}
+		})
+	}
+}
+
+func TestDirFiles(t *testing.T) {
+	t.Parallel()
+	writeFile := func(name string) func(t *testing.T, worktreePath string) {
+		return func(t *testing.T, worktreePath string) {
+			t.Helper()
+			filePath := filepath.Join(worktreePath, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0o700))
+			require.NoError(t, os.WriteFile(filePath, []byte("{}\n"), 0o600))
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		// make changes in the worktree, without committing them
+		setup    func(t *testing.T, worktreePath string)
+		ignore   []string
+		expected []string
+	}{
+		{
+			name: "changed file",
+			setup: func(t *testing.T, worktreePath string) {
+				t.Helper()
+				applyPatch(t, worktreePath, "change-in-unrelated-file.patch")
+			},
+			expected: []string{""},
+		},
+		{
+			name: "deleted file",
+			setup: func(t *testing.T, worktreePath string) {
+				t.Helper()
+				require.NoError(t, os.Remove(filepath.Join(worktreePath, modPath, "README.md")))
+			},
+			expected: []string{""},
+		},
+		{
+			name:     "file in subdirectory",
+			setup:    writeFile(filepath.Join(modPath, "internal", "utils", "config", "data.json")),
+			expected: []string{"/internal/utils", "/internal/consumer", ""},
+		},
+		{
+			name:     "file outside packages",
+			setup:    writeFile("data.json"),
+			expected: []string{},
+		},
+		{
+			name: "ignored by name",
+			setup: func(t *testing.T, worktreePath string) {
+				t.Helper()
+				applyPatch(t, worktreePath, "change-in-unrelated-file.patch")
+			},
+			ignore:   []string{"*.md"},
+			expected: []string{},
+		},
+		{
+			name:     "ignored by path",
+			setup:    writeFile(filepath.Join(modPath, "internal", "utils", "config", "data.json")),
+			ignore:   []string{"**/config/**"},
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleName(tc.expected)
+			worktreePath := testrepo.SetupWorktree(t)
+			tc.setup(t, worktreePath)
+
+			result, err := Get(context.Background(), Options{
+				RepoDir:        worktreePath,
+				ModDir:         filepath.Join(worktreePath, modPath),
+				FromRef:        "HEAD",
+				DirFiles:       true,
+				DirFilesIgnore: tc.ignore,
+			})
+
+			require.NoError(t, err)
+			compareResults(t, expected, result)
+		})
+	}
+}
+
+func TestTestdata(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		// file to write in the worktree, relative to the test module
+		file string
+		opts Options
+		// map of changed package -> whether only its tests are affected
+		expected map[string]bool
+	}{
+		{
+			name:     "testdata file",
+			file:     filepath.Join("internal", "utils", "testdata", "data.json"),
+			expected: map[string]bool{"/internal/utils": true},
+		},
+		{
+			name:     "fuzz corpus",
+			file:     filepath.Join("internal", "utils", "testdata", "fuzz", "FuzzUtils", "0123"),
+			expected: map[string]bool{"/internal/utils": true},
+		},
+		{
+			name:     "testdata file with dir files",
+			file:     filepath.Join("internal", "utils", "testdata", "data.json"),
+			opts:     Options{DirFiles: true},
+			expected: map[string]bool{"/internal/utils": true},
+		},
+		{
+			name:     "package without tests",
+			file:     filepath.Join("internal", "sql", "testdata", "data.json"),
+			expected: map[string]bool{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleNameToKeys(tc.expected)
+			worktreePath := testrepo.SetupWorktree(t)
+			filePath := filepath.Join(worktreePath, modPath, tc.file)
+			require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0o700))
+			require.NoError(t, os.WriteFile(filePath, []byte("{}\n"), 0o600))
+
+			opts := tc.opts
+			opts.RepoDir = worktreePath
+			opts.ModDir = filepath.Join(worktreePath, modPath)
+			opts.FromRef = "HEAD"
+			result, err := Get(context.Background(), opts)
+			require.NoError(t, err)
+
+			actual := make(map[string]bool, len(result.Packages))
+			for _, pkg := range result.Packages {
+				actual[pkg.PkgPath] = pkg.TestsOnly
+				require.Equal(t, []string{filepath.Join(modPath, tc.file)}, pkg.Reasons.Files)
+			}
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestBuildConfigs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		patch    string
+		opts     Options
+		expected []string
+	}{
+		{
+			name:     "imports in files with tags",
+			patch:    "change-in-embedded-file.patch",
+			opts:     Options{Tags: []string{"integration"}},
+			expected: []string{"/internal/sql", "/cmd/db", "/internal/consumer", ""},
+		},
+		{
+			name:  "imports on other platforms",
+			patch: "upgrade-first-level-dependency.patch",
+			opts:  Options{Platforms: []string{"linux/amd64", "windows/amd64"}},
+			// utils only imports golang.org/x/sys on windows
+			expected: []string{"/internal/utils", "/internal/consumer", "", "/cmd/db"},
+		},
+		{
+			name:     "package excluded on platform",
+			patch:    "add-windows-package.patch",
+			opts:     Options{Platforms: []string{"linux/amd64"}},
+			expected: []string{},
+		},
+		{
+			name:     "package excluded on some platforms",
+			patch:    "add-windows-package.patch",
+			opts:     Options{Platforms: []string{"linux/amd64", "windows/amd64"}},
+			expected: []string{"/internal/winutil"},
+		},
+		{
+			name:  "cgo on other platforms",
+			patch: "change-in-cgo-file.patch",
+			// as on the host, even though cgo is disabled when cross-compiling
+			opts:     Options{Platforms: []string{"darwin/arm64"}},
+			expected: []string{"/internal/sql", "/cmd/db"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleName(tc.expected)
+
+			result, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				tc.opts,
+			)
+			require.NoError(t, err)
+			compareResults(t, expected, result)
+		})
+	}
+}
+
+func TestBuildConfigsRespectCgoDisabled(t *testing.T) {
+	t.Setenv("CGO_ENABLED", "0")
+
+	result, err := getWithPatches(
+		t,
+		testrepo.SetupWorktree(t),
+		[]string{"change-in-cgo-file.patch"},
+		Options{},
+	)
+
+	require.NoError(t, err)
+	// there's no sql package without cgo
+	compareResults(t, []string{}, result)
+}
+
+func TestErrorsWhenPlatformIsInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := getWithPatches(
+		t,
+		testrepo.SetupWorktree(t),
+		[]string{"change-in-top-level-package.patch"},
+		Options{Platforms: []string{"linux"}},
+	)
+
+	require.EqualError(t, err, "invalid platform linux: expected GOOS/GOARCH")
+}
+
+func TestGetCgoRefs(t *testing.T) {
+	t.Parallel()
+	treeDir := t.TempDir()
+	pkgDir := filepath.Join(treeDir, "pkg")
+	for name, content := range map[string]string{
+		"pkg/pkg.go": "package pkg\n\n" +
+			"// #cgo CFLAGS: -I${SRCDIR} -I/usr/include -I${SRCDIR}/../include\n" +
+			"// #include <stdlib.h>\n" +
+			"// #include \"pkg.h\"\n" +
+			"// #include \"../common/strings.h\"\n" +
+			"import \"C\"\n",
+		// excluded by build constraints, and doesn't parse
+		"pkg/pkg_windows.go": "package pkg\n\nimport (\n",
+		"pkg/pkg.h":          "#include \"../common/chars.h\"\n",
+		"common/strings.h":   "#include <db.h>\n",
+	} {
+		path := filepath.Join(treeDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	pkg := &packages.Package{
+		ID:           "example.com/pkg",
+		PkgPath:      "example.com/pkg",
+		Dir:          pkgDir,
+		GoFiles:      []string{filepath.Join(pkgDir, "pkg.go")},
+		IgnoredFiles: []string{filepath.Join(pkgDir, "pkg_windows.go"), filepath.Join(pkgDir, "driver.c")},
+	}
+
+	refs := getCgoRefs(context.Background(), pkg, treeDir)
+
+	require.Equal(t, cgoRefs{
+		files: map[string]struct{}{
+			filepath.Join("common", "strings.h"): {},
+			filepath.Join("common", "chars.h"):   {},
+			filepath.Join("include", "pkg.h"):    {},
+			// not found in the package directory, so searched for in
+			// the include directories
+			filepath.Join("include", "db.h"):     {},
+			filepath.Join("include", "stdlib.h"): {},
+		},
+		dirs: map[string]struct{}{"include": {}},
+	}, refs)
+}
+
+func TestGetCgoPreamble(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{
+			name:     "import declaration comment",
+			src:      "package p\n\n// #include <stdio.h>\nimport \"C\"\n",
+			expected: "#include <stdio.h>\n",
+		},
+		{
+			name: "import spec comment",
+			src: "package p\n\n// not the preamble\nimport (\n" +
+				"\t\"fmt\"\n\n\t/*\n#include \"p.h\"\n*/\n\t\"C\"\n)\n",
+			expected: "#include \"p.h\"\n",
+		},
+		{
+			name:     "no cgo",
+			src:      "package p\n\nimport \"fmt\"\n\nfunc f() {}\n",
+			expected: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "p.go")
+			require.NoError(t, os.WriteFile(path, []byte(tc.src), 0o600))
+
+			preamble, err := getCgoPreamble(path)
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, preamble)
+		})
+	}
+}
+
+func TestParseInclude(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		line     string
+		expected cgoInclude
+		ok       bool
+	}{
+		{
+			line:     `#include "../common/strings.h"`,
+			expected: cgoInclude{dir: "pkg", header: "../common/strings.h", quoted: true},
+			ok:       true,
+		},
+		{
+			line:     "  #include <stdlib.h>",
+			expected: cgoInclude{dir: "pkg", header: "stdlib.h"},
+			ok:       true,
+		},
+		{line: "#include <stdlib.h", expected: cgoInclude{dir: "pkg", header: "stdlib.h"}},
+		{line: `#include "strings.h`, expected: cgoInclude{dir: "pkg", quoted: true}},
+		{line: "#define DEBUG"},
+	} {
+		t.Run(tc.line, func(t *testing.T) {
+			t.Parallel()
+			include, ok := parseInclude("pkg", tc.line)
+
+			require.Equal(t, tc.ok, ok)
+			require.Equal(t, tc.expected, include)
+		})
+	}
+}
+
+func TestParseIncludeDirs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		directive string
+		expected  []string
+	}{
+		{directive: "CFLAGS: -I${SRCDIR}/../include -DDEBUG", expected: []string{"/repo/include"}},
+		{directive: "linux CPPFLAGS: -I include -I", expected: []string{"/repo/pkg/include"}},
+		{directive: "CXXFLAGS: -I/usr/include/db", expected: []string{"/usr/include/db"}},
+		{directive: "LDFLAGS: -L/usr/lib/db"},
+		{directive: ": -Iinclude"},
+		{directive: "-Iinclude"},
+	} {
+		t.Run(tc.directive, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.expected, parseIncludeDirs(tc.directive, "/repo/pkg"))
+		})
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		glob     string
+		matches  []string
+		mismatch []string
+	}{
+		{
+			glob:     "Makefile",
+			matches:  []string{"Makefile"},
+			mismatch: []string{"sub/Makefile", "Makefile.old"},
+		},
+		{
+			glob:     "*.y?ml",
+			matches:  []string{".golangci.yaml", "config.yaml"},
+			mismatch: []string{"deploy/config.yaml", "config.yml"},
+		},
+		{
+			glob:     "**/Dockerfile",
+			matches:  []string{"Dockerfile", "cmd/app/Dockerfile"},
+			mismatch: []string{"Dockerfile.dev"},
+		},
+		{
+			glob:     "deploy/billing/**",
+			matches:  []string{"deploy/billing", "deploy/billing/k8s/app.yaml"},
+			mismatch: []string{"deploy/billing-v2/app.yaml"},
+		},
+		{
+			glob:     "deploy/**.yaml",
+			matches:  []string{"deploy/app.yaml", "deploy/billing/app.yaml"},
+			mismatch: []string{"deploy/app.json"},
+		},
+	} {
+		match := matchGlob(tc.glob)
+		for _, path := range tc.matches {
+			require.True(t, match(path), "%s should match %s", tc.glob, path)
+		}
+		for _, path := range tc.mismatch {
+			require.False(t, match(path), "%s shouldn't match %s", tc.glob, path)
+		}
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	t.Parallel()
+	config := []byte(`triggers:
+  - files: ["**/README.md"]
+    packages: ["./cmd/..."]
+`)
+	absPath := filepath.Join(t.TempDir(), "config.yaml")
+
+	for _, tc := range []struct {
+		name string
+		// where to write the config, relative to the worktree unless it's
+		// absolute
+		path string
+		// whether to commit the config, along with the patch
+		commit   bool
+		opts     Options
+		expected []string
+	}{
+		{
+			name:     "relative path",
+			path:     "config.yaml",
+			commit:   true,
+			opts:     Options{ConfigPath: "config.yaml"},
+			expected: []string{testModuleName + "/cmd/db"},
+		},
+		{
+			// only the config at the version compared against is used
+			name:     "uncommitted relative path",
+			path:     "config.yaml",
+			opts:     Options{ConfigPath: "config.yaml", ConfigOptional: true},
+			expected: []string{},
+		},
+		{
+			name:     "absolute path",
+			path:     absPath,
+			opts:     Options{ConfigPath: absPath},
+			expected: []string{testModuleName + "/cmd/db"},
+		},
+		{
+			name:     "missing absolute path",
+			opts:     Options{ConfigPath: filepath.Join(t.TempDir(), "missing.yaml"), ConfigOptional: true},
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			worktreePath := testrepo.SetupWorktree(t)
+			if tc.path != "" {
+				path := tc.path
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(worktreePath, path)
+				}
+				require.NoError(t, os.WriteFile(path, config, 0o600))
+			}
+			if tc.commit {
+				mustRunGitCmd(t, "-C", worktreePath, "add", tc.path)
+			}
+
+			result, err := getWithPatches(
+				t,
+				worktreePath,
+				[]string{"change-in-unrelated-file.patch"},
+				tc.opts,
+			)
+
+			require.NoError(t, err)
+			compareResults(t, tc.expected, result)
+		})
+	}
+}
+
+func TestConfigPathErrors(t *testing.T) {
+	t.Parallel()
+	missingPath := filepath.Join(t.TempDir(), "missing.yaml")
+
+	for _, tc := range []struct {
+		name        string
+		opts        Options
+		expectedErr string
+	}{
+		{
+			name:        "missing relative path",
+			opts:        Options{ConfigPath: "missing.yaml"},
+			expectedErr: "reading config file missing.yaml at ",
+		},
+		{
+			name:        "missing absolute path",
+			opts:        Options{ConfigPath: missingPath},
+			expectedErr: "reading config file " + missingPath + ": ",
+		},
+		{
+			// not a config at all
+			name:        "invalid config",
+			opts:        Options{ConfigPath: filepath.Join(modPath, "README.md")},
+			expectedErr: "parsing config file " + filepath.Join(modPath, "README.md") + ": ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := getWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{"change-in-unrelated-file.patch"},
+				tc.opts,
+			)
+
+			require.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		data     string
+		expected Config
+	}{
+		{
+			name: "triggers",
+			data: `triggers:
+  - files: ["deploy/billing/**"]
+    packages: ["./cmd/billing"]
+  - files: ["Makefile"]
+    all: true
+`,
+			expected: Config{Triggers: []Trigger{
+				{Files: []string{"deploy/billing/**"}, Packages: []string{"./cmd/billing"}},
+				{Files: []string{"Makefile"}, All: true},
+			}},
+		},
+		{
+			name: "empty",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.data), 0o600))
+
+			config, err := ReadConfig(path)
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, config)
+		})
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	invalidPath := filepath.Join(dir, "invalid.yaml")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("trigers: []\n"), 0o600))
+	missingPath := filepath.Join(dir, "missing.yaml")
+
+	_, err := ReadConfig(invalidPath)
+	require.ErrorContains(t, err, "parsing config file "+invalidPath+": ")
+
+	_, err = ReadConfig(missingPath)
+	require.ErrorContains(t, err, "reading config file "+missingPath+": ")
+}
+
+func TestNewModDir(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+	modDir := filepath.Join(worktreePath, "new")
+	require.NoError(t, os.Mkdir(modDir, 0o700))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(modDir, "go.mod"),
+		[]byte("module example.com/new\n\ngo 1.21\n"),
+		0o600,
+	))
+	require.NoError(t, os.WriteFile(filepath.Join(modDir, "new.go"), []byte("package new\n"), 0o600))
+	// deleted outside the new module, so doesn't affect it
+	require.NoError(t, os.Remove(filepath.Join(worktreePath, modPath, "README.md")))
+
+	result, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		ModDir:  modDir,
+		FromRef: "HEAD",
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, Result{
+		Packages: []Package{
+			{
+				PkgPath: "example.com/new",
+				Name:    "new",
+				Dir:     "new",
+				Status:  StatusAdded,
+				Reasons: Reasons{Files: []string{filepath.Join("new", "new.go")}},
+			},
+		},
+	}, result)
+}
+
+func TestLoadsPackagesAtToRef(t *testing.T) {
+	t.Parallel()
+	configs := loadTestConfigs(t)
+	patchName := "change-in-top-level-package.patch"
+	expected := configs[patchName]
+
+	worktreePath := testrepo.SetupWorktree(t)
+	modDir := filepath.Join(worktreePath, modPath)
+	prePatchHead, postPatchHead := testrepo.CommitModulePatches(t, worktreePath, "repo", patchName)
+
+	// break the package at HEAD, and leave an uncommitted change in the
+	// working tree, neither of which should be seen when inspecting the refs
+	testrepo.CommitModulePatches(t, worktreePath, "repo", "syntax-error-in-package.patch")
+	mustRunGitCmd(
+		t,
+		"-C",
+		worktreePath,
+		"apply",
+		testrepo.PatchPath(t, "repo", "change-in-second-level-package.patch"),
+	)
+
+	result, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		ModDir:  modDir,
+		FromRef: prePatchHead,
+		ToRef:   postPatchHead,
+	})
+	require.NoError(t, err)
+	compareResults(t, expected, result)
+}
+
+func TestErrorsWhenFailsToReadPackages(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+
+	_, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		// directory doesn't exist at the ref, so we can't load anything from it
+		ModDir:  filepath.Join(worktreePath, "does-not-exist"),
+		FromRef: "HEAD",
+		ToRef:   "HEAD",
+	})
+
+	require.ErrorContains(t, err, "failed listing local packages: ")
+}
+
+func TestErrorsWhenModDirOutsideRepoDir(t *testing.T) {
+	t.Parallel()
+	repoDir := t.TempDir()
+	modDir := t.TempDir()
+
+	_, err := Get(context.Background(), Options{RepoDir: repoDir, ModDir: modDir})
+
+	require.ErrorContains(t, err, "mod dir "+modDir+" is not inside repo dir "+repoDir)
+}
+
+func TestErrorsWithUnknownOptions(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		opts        Options
+		expectedErr string
+	}{
+		{
+			name:        "go version changes",
+			opts:        Options{GoVersionChanges: "ALL"},
+			expectedErr: `unknown go version changes "ALL"`,
+		},
+		{
+			name:        "order",
+			opts:        Options{Order: "topo"},
+			expectedErr: `unknown order "topo"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			repoDir := t.TempDir()
+			tc.opts.RepoDir = repoDir
+			tc.opts.ModDir = repoDir
+
+			_, err := Get(context.Background(), tc.opts)
+
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestErrorsWithUnsupportedPatterns(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		opts        Options
+		expectedErr string
+	}{
+		{
+			name:        "meta pattern",
+			opts:        Options{Patterns: []string{"./cmd/...", "all"}},
+			expectedErr: "unsupported pattern all: meta patterns aren't supported",
+		},
+		{
+			name:        "excluded meta pattern",
+			opts:        Options{Exclude: []string{"std"}},
+			expectedErr: "unsupported pattern std: meta patterns aren't supported",
+		},
+		{
+			name:        "absolute directory",
+			opts:        Options{Patterns: []string{"/src/cmd/..."}},
+			expectedErr: "unsupported pattern /src/cmd/...: use a path relative to the module directory",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			repoDir := t.TempDir()
+			tc.opts.RepoDir = repoDir
+			tc.opts.ModDir = repoDir
+
+			_, err := Get(context.Background(), tc.opts)
+
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestErrorsWhenFailstoListingChangedFiles(t *testing.T) {
+	t.Parallel()
+	// directory isn't a Git repo
+	repoDir := t.TempDir()
+
+	_, err := Get(context.Background(), Options{RepoDir: repoDir, ModDir: repoDir})
+
+	require.ErrorContains(t, err, "listing changed files: running command: `git")
+}
+
+func TestAddedFilesWithPackageErrorsBeforeChange(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+	// packages can't all be loaded before the change...
+	_, headSha := testrepo.CommitModulePatches(t, worktreePath, "repo", "syntax-error-in-package.patch")
+	// ...but can be afterwards
+	applyPatch(t, worktreePath, "syntax-error-in-package.patch", "--reverse", "--index")
+	newPath := filepath.Join(worktreePath, modPath, "internal", "sql", "new.go")
+	require.NoError(t, os.WriteFile(newPath, []byte("package sql\n"), 0o600))
+	mustRunGitCmd(t, "-C", worktreePath, "add", newPath)
+
+	result, err := Get(context.Background(), Options{
+		RepoDir: worktreePath,
+		ModDir:  filepath.Join(worktreePath, modPath),
+		FromRef: headSha,
+		Staged:  true,
+	})
+
+	require.NoError(t, err)
+	compareResults(t, []string{
+		testModuleName + "/internal/sql",
+		testModuleName + "/cmd/db",
+		testModuleName,
+	}, result)
+}
+
+func TestGoSumChanges(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		// committed before the patch compared against
+		setupPatch string
+		patch      string
+		expected   []string
+	}{
+		{
+			name: "changed hash",
+			// the go command checks hashes of modules it uses, so the old
+			// version has to be the broken one
+			setupPatch: "break-go-sum-hash.patch",
+			patch:      "fix-go-sum-hash.patch",
+			expected:   []string{"/internal/utils", "/internal/consumer", ""},
+		},
+		{
+			name:       "changed hash of replacement",
+			setupPatch: "break-replacement-go-sum-hash.patch",
+			patch:      "fix-replacement-go-sum-hash.patch",
+			expected:   []string{"/internal/utils", "/internal/consumer", ""},
+		},
+		{
+			name:       "changed hash of unused version",
+			setupPatch: "add-unused-go-sum-hash.patch",
+			patch:      "change-unused-go-sum-hash.patch",
+			expected:   []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := addModuleName(tc.expected)
+			worktreePath := testrepo.SetupWorktree(t)
+			testrepo.CommitModulePatches(t, worktreePath, "repo", tc.setupPatch)
+
+			result, err := getWithPatches(t, worktreePath, []string{tc.patch}, Options{})
+
+			require.NoError(t, err)
+			compareResults(t, expected, result)
+			for _, pkg := range result.Packages {
+				if pkg.PkgPath == testModuleName+"/internal/utils" {
+					require.Equal(t, []string{"golang.org/x/time"}, pkg.Reasons.Modules)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSumFile(t *testing.T) {
+	t.Parallel()
+
+	sums := parseSumFile("golang.org/x/mod v0.13.0 h1:I/DsJXRlw=\n" +
+		"golang.org/x/mod v0.13.0/go.mod h1:hTbmBsO6=\n" +
+		"golang.org/x/mod v0.12.0\n" +
+		"\n")
+
+	require.Equal(t, map[module.Version]string{
+		{Path: "golang.org/x/mod", Version: "v0.13.0"}:        "h1:I/DsJXRlw=",
+		{Path: "golang.org/x/mod", Version: "v0.13.0/go.mod"}: "h1:hTbmBsO6=",
+	}, sums)
+}
+
+func TestErrorsWhenFailingToParseGoMod(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+	// break `go.mod`...
+	_, headSha := testrepo.CommitModulePatches(t, worktreePath, "repo", "break-go-mod.patch")
+
+	//  ...and then fix it again so we can process packages at HEAD
+	_, err := getWithPatches(t, worktreePath, []string{"fix-go-mod.patch"}, Options{})
+
+	require.ErrorContains(
+		t,
+		err,
+		"parsing mod file "+filepath.Join(modPath, "go.mod")+" at "+headSha,
+	)
+}
+
+func TestErrorsWhenFailingToParseGoWork(t *testing.T) {
+	t.Parallel()
+	worktreePath := testrepo.SetupWorktree(t)
+	// break `go.work`...
+	_, headSha := testrepo.CommitModulePatches(t, worktreePath, "workspace", "break-go-work.patch")
+
+	//  ...and then fix it again so we can process packages at HEAD
+	_, err := getWorkspaceWithPatches(t, worktreePath, []string{"fix-go-work.patch"}, Options{})
+
+	require.ErrorContains(
+		t,
+		err,
+		"parsing workspace file "+
+			filepath.Join("changedpkgs", "testdata", "workspace", "go.work")+" at "+headSha,
+	)
+}
+
+func TestErrorsWhenFailsToQueryPackage(t *testing.T) {
+	t.Parallel()
+
+	_, err := getWithPatches(
+		t,
+		testrepo.SetupWorktree(t),
+		[]string{"syntax-error-in-package.patch"},
+		Options{},
+	)
+
+	require.ErrorContains(t, err, "failed querying package "+testModuleName)
+}
+
+func mustRunGitCmd(t *testing.T, args ...string) string {
+	t.Helper()
+
+	stdout, err := runGitCmd(context.Background(), args...)
+	require.NoError(t, err)
+	return stdout
+}
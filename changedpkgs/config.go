@@ -0,0 +1,127 @@
+package changedpkgs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gitlab.com/matthewhughes/slogctx"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a repo-level configuration file, see [ReadConfig].
+type Config struct {
+	Triggers []Trigger `yaml:"triggers"`
+}
+
+// Trigger marks packages changed when matching files change, for files that
+// don't belong to any package, e.g.
+//
+//	triggers:
+//	  - files: ["deploy/billing/**"]
+//	    packages: ["./cmd/billing"]
+//	  - files: ["Makefile"]
+//	    all: true
+type Trigger struct {
+	// globs matching files relative to the repo, where * matches within a
+	// path element and ** matches any number of directories
+	Files []string `yaml:"files"`
+	// package patterns for the packages to mark changed, as for
+	// [Options.Patterns]
+	Packages []string `yaml:"packages"`
+	// mark every package changed, rather than those matching Packages
+	All bool `yaml:"all"`
+}
+
+// ReadConfig reads the config file at `path`.
+func ReadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	return parseConfig(path, data)
+}
+
+// read the config file at [Options.ConfigPath], if any. A relative path is
+// read from the tree exported from `to` into `treeDir`, so the config used
+// is the one that goes with the changes, rather than whatever happens to be
+// checked out.
+func readOptionsConfig(treeDir string, to target, opts Options) (Config, error) {
+	if opts.ConfigPath == "" {
+		return Config{}, nil
+	}
+	if filepath.IsAbs(opts.ConfigPath) {
+		if _, err := os.Stat(opts.ConfigPath); opts.ConfigOptional && errors.Is(err, fs.ErrNotExist) {
+			return Config{}, nil
+		}
+		return ReadConfig(opts.ConfigPath)
+	}
+
+	data, err := os.ReadFile(filepath.Join(treeDir, opts.ConfigPath))
+	if opts.ConfigOptional && errors.Is(err, fs.ErrNotExist) {
+		return Config{}, nil
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("reading config file %s at %s: %w", opts.ConfigPath, to, err)
+	}
+	return parseConfig(opts.ConfigPath, data)
+}
+
+// parse the config file at `path` with the contents `data`.
+func parseConfig(path string, data []byte) (Config, error) {
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// an empty file is a valid, empty, config
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// mark packages changed by [Options.Triggers] for the changed files,
+// including deleted files.
+func collectTriggers(
+	ctx context.Context,
+	triggers []Trigger,
+	changes []fileChange,
+	pkgs map[string]Package,
+	relModDir string,
+	changedPackages map[string]*Reasons,
+) {
+	for _, trigger := range triggers {
+		var files []func(string) bool
+		for _, glob := range trigger.Files {
+			files = append(files, matchGlob(glob))
+		}
+		filter := newPackageFilter(trigger.Packages, nil, relModDir)
+
+		for _, change := range changes {
+			for _, path := range []string{change.path, change.oldPath} {
+				if path == "" || !slices.ContainsFunc(files, func(match func(string) bool) bool {
+					return match(filepath.ToSlash(path))
+				}) {
+					continue
+				}
+				for _, pkg := range pkgs {
+					if trigger.All || len(trigger.Packages) > 0 && filter.selects(pkg) {
+						slogctx.FromContext(ctx).Debug(
+							"package detected changed because of triggered file",
+							"package",
+							pkg.PkgPath,
+							"file",
+							path,
+						)
+						addReasons(changedPackages, pkg.PkgPath, Reasons{Files: []string{path}})
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package changedpkgs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// what [Options.FromRef] is compared against: either a ref, the index, or the
+// working tree.
+type target struct {
+	ref    string
+	staged bool
+}
+
+func (t target) String() string {
+	switch {
+	case t.ref != "":
+		return t.ref
+	case t.staged:
+		return "the index"
+	default:
+		return "the working tree"
+	}
+}
+
+// write the files of `to` into `treeDir`, without touching the working tree,
+// index, or worktree list of the repo at `repoDir`.
+func exportTree(ctx context.Context, repoDir string, to target, treeDir string) error {
+	// use a throwaway index so the repo's own index is left alone
+	indexPath := filepath.Join(treeDir, ".git-index")
+	indexEnv := "GIT_INDEX_FILE=" + indexPath
+
+	if to.ref != "" {
+		readTree := exec.CommandContext(ctx, "git", "-C", repoDir, "read-tree", to.ref)
+		readTree.Env = append(os.Environ(), indexEnv)
+		if _, err := runCmd(readTree); err != nil { //go-cov:skip // we've already diffed against this ref, so don't expect a failure
+			return fmt.Errorf("reading tree at %s: %w", to, err)
+		}
+	} else {
+		if err := copyIndex(ctx, repoDir, indexPath); err != nil {
+			return err
+		}
+		if !to.staged {
+			// stage everything in the copy, including untracked files, so
+			// it matches the working tree
+			add := exec.CommandContext(ctx, "git", "-C", repoDir, "add", "--all")
+			add.Env = append(os.Environ(), indexEnv)
+			if _, err := runCmd(add); err != nil { //go-cov:skip // we've already listed these files, so don't expect a failure
+				return fmt.Errorf("reading files in %s: %w", to, err)
+			}
+		}
+	}
+
+	checkoutIndex := exec.CommandContext(
+		ctx,
+		"git",
+		"-C",
+		repoDir,
+		"checkout-index",
+		"--all",
+		// the trailing separator is significant: without it the prefix is
+		// prepended to each file name rather than treated as a directory
+		"--prefix="+treeDir+string(filepath.Separator),
+	)
+	checkoutIndex.Env = append(os.Environ(), indexEnv)
+	if _, err := runCmd(checkoutIndex); err != nil { //go-cov:skip // as above
+		return fmt.Errorf("exporting tree at %s: %w", to, err)
+	}
+
+	return nil
+}
+
+// copy the index of the repo at `repoDir` to `dest`.
+func copyIndex(ctx context.Context, repoDir string, dest string) error {
+	out, err := runGitCmd(ctx, "-C", repoDir, "rev-parse", "--path-format=absolute", "--git-path", "index")
+	if err != nil { //go-cov:skip // we've already diffed against the index, so don't expect a failure
+		return fmt.Errorf("finding index: %w", err)
+	}
+
+	data, err := os.ReadFile(strings.TrimSpace(out))
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+	if err := os.WriteFile(dest, data, 0o600); err != nil { //go-cov:skip // we've just created this directory, so don't expect a failure
+		return fmt.Errorf("copying index: %w", err)
+	}
+	return nil
+}
+
+// get the best common ancestor of `fromRef` and `to`, where the working tree
+// and index are both based on HEAD.
+func getMergeBase(ctx context.Context, repoDir string, fromRef string, to target) (string, error) {
+	toRef := to.ref
+	if toRef == "" {
+		toRef = "HEAD"
+	}
+	out, err := runGitCmd(ctx, "-C", repoDir, "merge-base", fromRef, toRef)
+	if err != nil {
+		return "", fmt.Errorf("finding merge base of %s and %s: %w", fromRef, toRef, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// a file changed between [Options.FromRef] and `to`.
+type fileChange struct {
+	// path at `to`, relative to the repo. Empty if the file was deleted
+	path string
+	// path at [Options.FromRef], relative to the repo. Empty if the file was
+	// added
+	oldPath string
+}
+
+func getChangedFiles(
+	ctx context.Context,
+	repoDir string,
+	fromRef string,
+	to target,
+) ([]fileChange, error) {
+	diffArgs := []string{"-C", repoDir, "diff", "--name-status", "--find-renames", "-z"}
+	switch {
+	case to.ref != "":
+		diffArgs = append(diffArgs, fromRef, to.ref)
+	case to.staged:
+		diffArgs = append(diffArgs, "--cached", fromRef)
+	default:
+		diffArgs = append(diffArgs, fromRef)
+	}
+	out, err := runGitCmd(ctx, diffArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("listing changed files: %w", err)
+	}
+	changes := parseNameStatus(splitPaths(out))
+
+	if to.ref == "" && !to.staged {
+		// `git diff` only includes files Git already knows about
+		out, err := runGitCmd(ctx, "-C", repoDir, "ls-files", "--others", "--exclude-standard", "-z")
+		if err != nil { //go-cov:skip // we've just run a Git command here, so don't expect a failure
+			return nil, fmt.Errorf("listing untracked files: %w", err)
+		}
+		for _, path := range splitPaths(out) {
+			changes = append(changes, fileChange{path: path})
+		}
+	}
+
+	return changes, nil
+}
+
+// parse the fields output by `git diff --name-status -z`: a status followed by
+// a path, or two paths for renames.
+func parseNameStatus(fields []string) []fileChange {
+	var changes []fileChange
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, path := fields[i], fields[i+1]
+		switch status[0] {
+		case 'A':
+			changes = append(changes, fileChange{path: path})
+		case 'D':
+			changes = append(changes, fileChange{oldPath: path})
+		case 'R':
+			i++
+			changes = append(changes, fileChange{path: fields[i+1], oldPath: path})
+		default:
+			changes = append(changes, fileChange{path: path, oldPath: path})
+		}
+	}
+	return changes
+}
+
+// split the output of a Git command listing paths with `-z`.
+func splitPaths(out string) []string {
+	if out == "" {
+		return nil
+	}
+	// there's always a trailing '\x00' so trim that element
+	return strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+}
+
+// A convenience func for running commands.
+// Upon success returns the string written from the command's stdout.
+// Upton failure returns an error include details from the command's stderr.
+func runCmd(cmd *exec.Cmd) (string, error) {
+	var stdout strings.Builder
+	var stderr strings.Builder
+
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf(
+			"running command: `%s`: %w\nstderr: %s",
+			strings.Join(cmd.Args, " "),
+			err,
+			stderr.String(),
+		)
+	}
+
+	return stdout.String(), nil
+}
+
+func runGitCmd(ctx context.Context, args ...string) (string, error) {
+	return runCmd(exec.CommandContext(ctx, "git", args...))
+}
+
+func runGoCmd(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Env = goEnv()
+	return runCmd(cmd)
+}
+
+// the environment to run the go command in. Any -mod flag is dropped from
+// GOFLAGS: it's meant for the caller's own builds, and e.g. `-mod=mod` is
+// rejected in workspace mode.
+func goEnv() []string {
+	goFlags := strings.Fields(os.Getenv("GOFLAGS"))
+	keptFlags := slices.DeleteFunc(slices.Clone(goFlags), func(flag string) bool {
+		return strings.HasPrefix(flag, "-mod=") || strings.HasPrefix(flag, "--mod=")
+	})
+	if len(keptFlags) == len(goFlags) {
+		// leave GOFLAGS alone, so any value set with `go env -w` still applies
+		return os.Environ()
+	}
+	return append(os.Environ(), "GOFLAGS="+strings.Join(keptFlags, " "))
+}
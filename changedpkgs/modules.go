@@ -0,0 +1,700 @@
+package changedpkgs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gitlab.com/matthewhughes/slogctx"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+)
+
+// pseudo-module for the standard library, considered changed when the go or
+// toolchain version of a module changes.
+const _stdModule = "std"
+
+// get patterns matching all packages in all modules of the workspace
+// containing `modDir`, see findWorkspace.
+func getWorkspacePatterns(ctx context.Context, modDir string) ([]string, error) {
+	workPath, err := findWorkspace(ctx, modDir)
+	if err != nil {
+		return nil, err
+	}
+
+	workData, err := os.ReadFile(workPath)
+	if err != nil {
+		// GOWORK may name a file that doesn't exist
+		return nil, fmt.Errorf("reading workspace file %s: %w", workPath, err)
+	}
+	workFile, err := modfile.ParseWork(workPath, workData, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing workspace file %s: %w", workPath, err)
+	}
+
+	patterns := make([]string, 0, len(workFile.Use))
+	for _, use := range workFile.Use {
+		useDir := use.Path
+		if !filepath.IsAbs(useDir) {
+			useDir = filepath.Join(filepath.Dir(workPath), useDir)
+		}
+		relDir, err := filepath.Rel(modDir, useDir)
+		if err != nil { //go-cov:skip // both are absolute paths, so we don't expect a failure
+			return nil, fmt.Errorf("building relative path for %s: %w", useDir, err)
+		}
+		patterns = append(patterns, "./"+path.Join(filepath.ToSlash(relDir), "..."))
+	}
+
+	return patterns, nil
+}
+
+// find the go.work file of the workspace containing `modDir`. If there's no
+// such workspace, then one is created in `modDir` containing every module
+// under it.
+func findWorkspace(ctx context.Context, modDir string) (string, error) {
+	workPath, err := getWorkPath(ctx, modDir)
+	if err != nil { //go-cov:skip // we don't really ever expect a failure
+		return "", err
+	}
+
+	if workPath == "off" {
+		return "", errors.New("can't load a workspace with GOWORK=off")
+	}
+	if workPath == "" {
+		modDirs, err := findModuleDirs(modDir)
+		if err != nil { //go-cov:skip // we don't really ever expect a failure
+			return "", err
+		}
+		if len(modDirs) == 0 {
+			return "", fmt.Errorf("no modules found under %s", modDir)
+		}
+		slogctx.FromContext(ctx).Info("creating workspace", "modules", modDirs)
+
+		initArgs := append([]string{"-C", modDir, "work", "init"}, modDirs...)
+		if _, err := runGoCmd(ctx, initArgs...); err != nil {
+			return "", fmt.Errorf("creating workspace in %s: %w", modDir, err)
+		}
+		workPath = filepath.Join(modDir, "go.work")
+	}
+	return workPath, nil
+}
+
+// get the go.work file the go command uses in `modDir`: empty if there's
+// none, or "off" if workspace mode is disabled.
+func getWorkPath(ctx context.Context, modDir string) (string, error) {
+	out, err := runGoCmd(ctx, "-C", modDir, "env", "GOWORK")
+	if err != nil { //go-cov:skip // we don't really ever expect a failure
+		return "", fmt.Errorf("finding workspace for %s: %w", modDir, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// find the directories, relative to `root`, of all modules under `root`,
+// skipping any directories that the go command would ignore when matching
+// packages.
+func findModuleDirs(root string) ([]string, error) {
+	var modDirs []string
+	err := filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil { //go-cov:skip // we don't really ever expect a failure
+			return err
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if filePath != root &&
+				(name == "testdata" || name == "vendor" ||
+					strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == "go.mod" {
+			relDir, err := filepath.Rel(root, filepath.Dir(filePath))
+			if err != nil { //go-cov:skip // both are absolute paths, so we don't expect a failure
+				return err
+			}
+			modDirs = append(modDirs, "./"+filepath.ToSlash(relDir))
+		}
+		return nil
+	})
+	if err != nil { //go-cov:skip // we don't really ever expect a failure
+		return nil, fmt.Errorf("finding modules under %s: %w", root, err)
+	}
+
+	return modDirs, nil
+}
+
+func loadLocalPackages(
+	ctx context.Context,
+	modDir string,
+	patterns []string,
+	buildCfg buildConfig,
+	allowErrors bool,
+) ([]*packages.Package, error) {
+	slogctx.FromContext(ctx).Debug(
+		"loading packages",
+		"dir", modDir,
+		"goos", buildCfg.goos,
+		"goarch", buildCfg.goarch,
+		"tags", buildCfg.tags,
+	)
+	loadCfg := packages.Config{
+		Context: ctx,
+		Mode: packages.NeedName |
+			packages.NeedFiles |
+			packages.NeedEmbedFiles |
+			packages.NeedEmbedPatterns |
+			// this runs `go list` with `-deps` which means
+			// "... a package is listed only after all its dependencies" (see the `go list` docs)
+			packages.NeedImports |
+			packages.NeedDeps |
+			// include the module: so we can map imports of 3rd party packages
+			// to a module
+
+			packages.NeedModule,
+		Dir: modDir,
+		// include test variants of packages, so changes to _test.go files
+		// are attributed to the package they test
+		Tests: true,
+	}
+	loadCfg.Env = goEnv()
+	if _, ok := os.LookupEnv("CGO_ENABLED"); !ok {
+		// cgo is disabled by default when cross-compiling, or without a C
+		// compiler, which would leave out cgo files and their imports. Just
+		// listing files doesn't run the C compiler anyway
+		loadCfg.Env = append(loadCfg.Env, "CGO_ENABLED=1")
+	}
+	if buildCfg.goos != "" {
+		loadCfg.Env = append(loadCfg.Env, "GOOS="+buildCfg.goos, "GOARCH="+buildCfg.goarch)
+	}
+	if len(buildCfg.tags) > 0 {
+		loadCfg.BuildFlags = []string{"-tags=" + strings.Join(buildCfg.tags, ",")}
+	}
+	pkgs, err := packages.Load(&loadCfg, patterns...)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing local packages: %w", err)
+	}
+
+	// early check for errors in packages, e.g. we can't load one because of a
+	// syntax error in the source
+	for _, pkg := range pkgs {
+		errs := slices.DeleteFunc(slices.Clone(pkg.Errors), func(err packages.Error) bool {
+			// the package just doesn't exist in this build configuration,
+			// but may in others
+			return strings.Contains(err.Msg, "build constraints exclude all Go files")
+		})
+		if len(errs) == 0 {
+			continue
+		}
+		if allowErrors && pkg.Dir != "" {
+			// the package was found, it's just broken. Otherwise the go
+			// command failed to list anything
+			slogctx.FromContext(ctx).Debug("ignoring package errors", "package", pkg.ID, "errors", errs)
+			continue
+		}
+		return nil, fmt.Errorf("failed querying package %s: %v", pkg.PkgPath, errs)
+	}
+
+	return withLocalDeps(pkgs), nil
+}
+
+// a configuration to load packages with, the host's by default.
+type buildConfig struct {
+	goos   string
+	goarch string
+	tags   []string
+}
+
+// get the build configurations to load packages with: one for each of
+// [Options.Platforms], all with [Options.Tags].
+func getBuildConfigs(opts Options) ([]buildConfig, error) {
+	if len(opts.Platforms) == 0 {
+		return []buildConfig{{tags: opts.Tags}}, nil
+	}
+
+	configs := make([]buildConfig, 0, len(opts.Platforms))
+	for _, platform := range opts.Platforms {
+		goos, goarch, ok := strings.Cut(platform, "/")
+		if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+			return nil, fmt.Errorf("invalid platform %s: expected GOOS/GOARCH", platform)
+		}
+		configs = append(configs, buildConfig{goos: goos, goarch: goarch, tags: opts.Tags})
+	}
+	return configs, nil
+}
+
+// merge the packages loaded with each build configuration into a single
+// graph, where each package has the files and imports it has in any of the
+// configurations. As with loadLocalPackages, local packages are listed after
+// the local packages they import.
+func mergeGraphs(graphs [][]*packages.Package) []*packages.Package {
+	if len(graphs) == 1 {
+		return graphs[0]
+	}
+
+	merged := map[string]*packages.Package{}
+	local := map[string]struct{}{}
+	var roots []*packages.Package
+	for _, pkgs := range graphs {
+		// post-order, so the imports of a package are merged before it
+		packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+			mergedPkg, ok := merged[pkg.ID]
+			if !ok {
+				mergedPkg = &packages.Package{
+					ID:      pkg.ID,
+					Name:    pkg.Name,
+					PkgPath: pkg.PkgPath,
+					Dir:     pkg.Dir,
+					Module:  pkg.Module,
+					Imports: map[string]*packages.Package{},
+				}
+				merged[pkg.ID] = mergedPkg
+			}
+			for _, files := range []struct{ to, from *[]string }{
+				{&mergedPkg.GoFiles, &pkg.GoFiles},
+				{&mergedPkg.OtherFiles, &pkg.OtherFiles},
+				{&mergedPkg.EmbedPatterns, &pkg.EmbedPatterns},
+				{&mergedPkg.EmbedFiles, &pkg.EmbedFiles},
+				{&mergedPkg.IgnoredFiles, &pkg.IgnoredFiles},
+			} {
+				for _, file := range *files.from {
+					if !slices.Contains(*files.to, file) {
+						*files.to = append(*files.to, file)
+					}
+				}
+			}
+			for importPath, importPkg := range pkg.Imports {
+				mergedPkg.Imports[importPath] = merged[importPkg.ID]
+			}
+		})
+		for _, pkg := range pkgs {
+			if _, ok := local[pkg.ID]; !ok {
+				local[pkg.ID] = struct{}{}
+				roots = append(roots, merged[pkg.ID])
+			}
+		}
+	}
+
+	// a package can import another in one configuration, but be imported by
+	// it in another, in which case there's no correct order
+	var ordered []*packages.Package
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		if _, ok := local[pkg.ID]; ok {
+			ordered = append(ordered, pkg)
+		}
+	})
+	return ordered
+}
+
+// get the local packages in `pkgs`, and those they import, directly or
+// indirectly, including any that weren't matched by the patterns they were
+// loaded with, so changes propagate through them. Packages from other
+// modules or the standard library matched by the patterns are left out.
+// Packages are listed after their dependencies.
+func withLocalDeps(pkgs []*packages.Package) []*packages.Package {
+	testBinaries := getTestBinaries(pkgs)
+	localPaths := map[string]struct{}{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if pkg.Module != nil && pkg.Module.Main {
+			localPaths[pkg.PkgPath] = struct{}{}
+		}
+	})
+
+	var local []*packages.Package
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		isLocal := pkg.Module != nil && pkg.Module.Main
+		if _, ok := testBinaries[pkg.ID]; ok {
+			// test binaries have no module
+			_, isLocal = localPaths[basePkgPath(pkg.ID, testBinaries)]
+		}
+		if isLocal {
+			local = append(local, pkg)
+		}
+	})
+	return local
+}
+
+// get the 3rd party modules changed in the go.mod at `modPath`, exported
+// from `fromRef` into `oldTreeDir` and from `to` into `treeDir`. If `isLocal`
+// then the go.mod is for one of the modules we've loaded packages from, and
+// so a change to its go or toolchain versions changes the standard library.
+// Though not its toolchain version `inWorkspace`, where the workspace's is
+// used instead.
+func getChangedMods(
+	ctx context.Context,
+	modPath string,
+	repoDir string,
+	treeDir string,
+	oldTreeDir string,
+	fromRef string,
+	to target,
+	isLocal bool,
+	inWorkspace bool,
+) (map[string]struct{}, error) {
+	curModFile, oldModFile, err := readModFiles(ctx, repoDir, treeDir, modPath, fromRef, to)
+	if err != nil {
+		return nil, err
+	}
+
+	changedMods := map[string]struct{}{}
+	toolchainChanged := !inWorkspace && toolchainVersion(curModFile.Toolchain) != toolchainVersion(oldModFile.Toolchain)
+	if isLocal && (goVersion(curModFile.Go) != goVersion(oldModFile.Go) || toolchainChanged) {
+		changedMods[_stdModule] = struct{}{}
+	}
+
+	oldBuildList := getRequirements(oldModFile)
+	curBuildList := getRequirements(curModFile)
+	if isLocal {
+		// compare the whole build list rather than just the requirements: a
+		// new requirement, or a changed replacement, can change the version
+		// of any module in the graph. Only for local modules though, since
+		// the go command may not be able to resolve the graph of any other
+		oldList, oldErr := getBuildList(ctx, oldTreeDir, modPath, fromRef)
+		curList, curErr := getBuildList(ctx, treeDir, modPath, to.String())
+		if err := errors.Join(oldErr, curErr); err != nil {
+			slogctx.FromContext(ctx).Warn(
+				"failed listing modules, so only comparing requirements",
+				"go.mod",
+				modPath,
+				"error",
+				err,
+			)
+		} else {
+			oldBuildList, curBuildList = oldList, curList
+		}
+	}
+
+	// we're not interested in modules that are no longer in the build list,
+	// since no packages should currently depend on them
+	for modPath, version := range curBuildList {
+		if oldBuildList[modPath] != version {
+			changedMods[modPath] = struct{}{}
+		}
+	}
+
+	diffReplacements(oldModFile.Replace, curModFile.Replace, changedMods)
+	return changedMods, nil
+}
+
+// get the 3rd party modules changed in the go.work at `workPath`, exported
+// from `fromRef` into `oldTreeDir` and from `to` into `treeDir`, which
+// packages were loaded with. Its go and toolchain versions are used rather
+// than those of its modules, so a change to either changes the standard
+// library.
+func getChangedWorkMods(
+	workPath string,
+	treeDir string,
+	oldTreeDir string,
+	fromRef string,
+	to target,
+) (map[string]struct{}, error) {
+	oldWorkFile, err := readWorkFile(oldTreeDir, workPath, fromRef)
+	if err != nil {
+		return nil, err
+	}
+	curWorkFile, err := readWorkFile(treeDir, workPath, to.String())
+	if err != nil { //go-cov:skip // we've already loaded packages with this file, so don't expect a failure
+		return nil, err
+	}
+
+	changedMods := map[string]struct{}{}
+	if goVersion(curWorkFile.Go) != goVersion(oldWorkFile.Go) ||
+		toolchainVersion(curWorkFile.Toolchain) != toolchainVersion(oldWorkFile.Toolchain) {
+		changedMods[_stdModule] = struct{}{}
+	}
+	diffReplacements(oldWorkFile.Replace, curWorkFile.Replace, changedMods)
+	return changedMods, nil
+}
+
+// read the go.work at `workPath` in the tree exported from `at` into
+// `treeDir`.
+func readWorkFile(treeDir string, workPath string, at string) (*modfile.WorkFile, error) {
+	workData, err := os.ReadFile(filepath.Join(treeDir, workPath))
+	if err != nil { //go-cov:skip // we only read files that exist at both versions
+		return nil, fmt.Errorf("reading %s at %s: %w", workPath, at, err)
+	}
+	workFile, err := modfile.ParseWork(workPath, workData, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing workspace file %s at %s: %w", workPath, at, err)
+	}
+	return workFile, nil
+}
+
+// add the modules whose replacements differ between `oldReplace` and
+// `curReplace` to `changedMods`. Unlike requirements, any change to a
+// replacement (including adding or removing one) changes the code used for a
+// module, even if it's selected at the same version.
+func diffReplacements(
+	oldReplace []*modfile.Replace,
+	curReplace []*modfile.Replace,
+	changedMods map[string]struct{},
+) {
+	oldReplaceMap := map[module.Version]module.Version{}
+	for _, rep := range oldReplace {
+		oldReplaceMap[rep.Old] = rep.New
+	}
+	for _, rep := range curReplace {
+		if old, ok := oldReplaceMap[rep.Old]; !ok || old != rep.New {
+			changedMods[rep.Old.Path] = struct{}{}
+		}
+		delete(oldReplaceMap, rep.Old)
+	}
+	for old := range oldReplaceMap {
+		changedMods[old.Path] = struct{}{}
+	}
+}
+
+// get the modules required by `modFile`, as a map of path to version: like a
+// build list, but without anything only required indirectly.
+func getRequirements(modFile *modfile.File) map[string]string {
+	reqs := make(map[string]string, len(modFile.Require))
+	for _, req := range modFile.Require {
+		reqs[req.Mod.Path] = req.Mod.Version
+	}
+	return reqs
+}
+
+// get the build list of the module with the go.mod at `modPath` in the tree
+// exported from `at` into `treeDir`, or of the workspace it's in: a map of the
+// path of each module, other than the main modules, to its selected version
+// and any replacement.
+func getBuildList(
+	ctx context.Context,
+	treeDir string,
+	modPath string,
+	at string,
+) (map[string]string, error) {
+	out, err := runGoCmd(
+		ctx,
+		"-C",
+		filepath.Join(treeDir, filepath.Dir(modPath)),
+		"list",
+		// never vendor mode, which can't list the build list
+		"-mod=readonly",
+		// report modules that can't be loaded, e.g. required workspace
+		// modules or missing replacements, rather than failing
+		"-e",
+		"-m",
+		"-json",
+		"all",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing modules required by %s at %s: %w", modPath, at, err)
+	}
+
+	buildList := map[string]string{}
+	decoder := json.NewDecoder(strings.NewReader(out))
+	for {
+		var mod packages.Module
+		if err := decoder.Decode(&mod); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil { //go-cov:skip // we don't expect the go command to output invalid JSON
+			return nil, fmt.Errorf("parsing modules required by %s at %s: %w", modPath, at, err)
+		}
+		if mod.Main {
+			continue
+		}
+		version := mod.Version
+		if mod.Replace != nil {
+			version += " => " + mod.Replace.Path + " " + mod.Replace.Version
+		}
+		buildList[mod.Path] = version
+	}
+	return buildList, nil
+}
+
+// get the 3rd party modules used by `pkgs` with a different hash at the same
+// version in the go.sum at `sumPath` at `fromRef`, and as exported from `to`
+// into `treeDir`. `usedMods` maps the versions of modules used, after any
+// replacement, to the path of the module they're used for.
+func getChangedSums(
+	ctx context.Context,
+	sumPath string,
+	repoDir string,
+	treeDir string,
+	fromRef string,
+	to target,
+	usedMods map[module.Version]string,
+) (map[string]struct{}, error) {
+	oldData, err := runGitCmd(ctx, "-C", repoDir, "show", fmt.Sprintf("%s:%s", fromRef, sumPath))
+	if err != nil { //go-cov:skip // we only read files that exist at both versions
+		return nil, fmt.Errorf("reading %s at %s: %w", sumPath, fromRef, err)
+	}
+	data, err := os.ReadFile(filepath.Join(treeDir, sumPath))
+	if err != nil { //go-cov:skip // we only read files that exist at both versions
+		return nil, fmt.Errorf("reading %s at %s: %w", sumPath, to, err)
+	}
+
+	oldSums := parseSumFile(oldData)
+	changedMods := map[string]struct{}{}
+	for mod, hash := range parseSumFile(string(data)) {
+		oldHash, ok := oldSums[mod]
+		if !ok || oldHash == hash {
+			continue
+		}
+		// the hash of just the go.mod of a module version is listed under
+		// the version with a /go.mod suffix
+		usedMod := module.Version{Path: mod.Path, Version: strings.TrimSuffix(mod.Version, "/go.mod")}
+		modPath, ok := usedMods[usedMod]
+		if !ok {
+			continue
+		}
+		// the content of a module version shouldn't ever change
+		slogctx.FromContext(ctx).Warn(
+			"hash changed for the same module version, which may mean it was tampered with or a proxy is broken",
+			"go.sum",
+			sumPath,
+			"module",
+			mod.Path,
+			"version",
+			mod.Version,
+		)
+		changedMods[modPath] = struct{}{}
+	}
+	return changedMods, nil
+}
+
+// parse the lines of a go.sum, like `golang.org/x/mod v0.13.0 h1:...=`, into
+// a map of module version to hash. Malformed lines are ignored, as the go
+// command would already fail to load packages with them.
+func parseSumFile(data string) map[module.Version]string {
+	sums := map[module.Version]string{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		sums[module.Version{Path: fields[0], Version: fields[1]}] = fields[2]
+	}
+	return sums
+}
+
+// get the versions of 3rd party modules `pkgs` import packages from, mapped
+// to the path of the module they're used for: the versions hashed in go.sum
+// are those of replacements, if the module is replaced.
+func getUsedModules(pkgs []*packages.Package) map[module.Version]string {
+	usedMods := map[module.Version]string{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		mod := pkg.Module
+		if mod == nil || mod.Main {
+			return
+		}
+		used := module.Version{Path: mod.Path, Version: mod.Version}
+		if mod.Replace != nil {
+			// a replacement without a version is a local directory, which
+			// isn't hashed
+			if mod.Replace.Version == "" {
+				return
+			}
+			used = module.Version{Path: mod.Replace.Path, Version: mod.Replace.Version}
+		}
+		usedMods[used] = mod.Path
+	})
+	return usedMods
+}
+
+func goVersion(goLine *modfile.Go) string {
+	if goLine == nil {
+		return ""
+	}
+	return goLine.Version
+}
+
+func toolchainVersion(toolchain *modfile.Toolchain) string {
+	if toolchain == nil {
+		return ""
+	}
+	return toolchain.Name
+}
+
+// get the absolute paths of the go.mod files of the modules `pkgs` belong to.
+func getLocalGoMods(pkgs []*packages.Package) map[string]struct{} {
+	goMods := map[string]struct{}{}
+	for _, pkg := range pkgs {
+		if pkg.Module != nil && pkg.Module.Main {
+			goMods[pkg.Module.GoMod] = struct{}{}
+		}
+	}
+	return goMods
+}
+
+// get the directories of all modules replaced by a local directory that are
+// used by `pkgs`, as a map of module path to absolute directory.
+func getLocalReplacements(pkgs []*packages.Package) map[string]string {
+	replacements := map[string]string{}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		mod := pkg.Module
+		// a replacement without a version is a local directory
+		if mod != nil && mod.Replace != nil && mod.Replace.Version == "" {
+			replacements[mod.Path] = mod.Replace.Dir
+		}
+	})
+	return replacements
+}
+
+func fileInDir(dir string, absPath string) bool {
+	relPath, err := filepath.Rel(dir, absPath)
+	return err == nil && filepath.IsLocal(relPath)
+}
+
+// read the go.mod at `modPath` at `fromRef`, and as exported from `to` into
+// `treeDir`.
+func readModFiles(
+	ctx context.Context,
+	repoDir string,
+	treeDir string,
+	modPath string,
+	fromRef string,
+	to target,
+) (*modfile.File, *modfile.File, error) {
+	oldModFile, err := readModFileAtRef(ctx, repoDir, modPath, fromRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	modData, err := os.ReadFile(filepath.Join(treeDir, modPath))
+	if err != nil { //go-cov:skip // we only read files that exist at both versions
+		return nil, nil, fmt.Errorf("reading %s at %s: %w", modPath, to, err)
+	}
+	newModFile, err := parseModFile(modPath, modData, to.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newModFile, oldModFile, nil
+}
+
+func readModFileAtRef(
+	ctx context.Context,
+	repoDir string,
+	modPath string,
+	ref string,
+) (*modfile.File, error) {
+	modData, err := runGitCmd(
+		ctx,
+		"-C",
+		repoDir,
+		"show",
+		fmt.Sprintf("%s:%s", ref, modPath),
+	)
+	if err != nil { //go-cov:skip // we only read files that exist at both versions
+		return nil, fmt.Errorf("reading %s at %s: %w", modPath, ref, err)
+	}
+	return parseModFile(modPath, []byte(modData), ref)
+}
+
+// parse the go.mod at `modPath`, read from `at`.
+func parseModFile(modPath string, data []byte, at string) (*modfile.File, error) {
+	modFile, err := modfile.Parse(modPath, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing mod file %s at %s: %w", modPath, at, err)
+	}
+	return modFile, nil
+}
@@ -0,0 +1,118 @@
+package changedpkgs
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// selects packages to report by package patterns, see [Options.Patterns]
+// and [Options.Exclude].
+type packageFilter struct {
+	include []func(Package) bool
+	exclude []func(Package) bool
+}
+
+func newPackageFilter(include []string, exclude []string, relModDir string) packageFilter {
+	var filter packageFilter
+	for _, pattern := range include {
+		filter.include = append(filter.include, matchPattern(pattern, relModDir))
+	}
+	for _, pattern := range exclude {
+		filter.exclude = append(filter.exclude, matchPattern(pattern, relModDir))
+	}
+	return filter
+}
+
+// split `pkgs` into those the filter selects, and the rest.
+func (f packageFilter) split(pkgs []Package) ([]Package, []Package) {
+	var selected, rest []Package
+	for _, pkg := range pkgs {
+		if f.selects(pkg) {
+			selected = append(selected, pkg)
+		} else {
+			rest = append(rest, pkg)
+		}
+	}
+	return selected, rest
+}
+
+func (f packageFilter) selects(pkg Package) bool {
+	matches := func(match func(Package) bool) bool { return match(pkg) }
+	if len(f.include) > 0 && !slices.ContainsFunc(f.include, matches) {
+		return false
+	}
+	return !slices.ContainsFunc(f.exclude, matches)
+}
+
+// check `patterns` are supported by [matchPattern]. Meta patterns like
+// "all" would also match packages outside the module, and the packages of
+// an absolute directory pattern can't be found from their import paths.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "all" || pattern == "std" || pattern == "cmd" || pattern == "tool":
+			return fmt.Errorf("unsupported pattern %s: meta patterns aren't supported", pattern)
+		case path.IsAbs(pattern) || filepath.IsAbs(pattern):
+			return fmt.Errorf("unsupported pattern %s: use a path relative to the module directory", pattern)
+		}
+	}
+	return nil
+}
+
+// match packages against a pattern as accepted by the go command: either an
+// import path pattern, or a relative pattern like ./cmd/... matching the
+// package's directory relative to the module at `relModDir`. As with the go
+// command, "..." matches any string, and a trailing "/..." also matches
+// nothing.
+func matchPattern(pattern string, relModDir string) func(Package) bool {
+	relative := pattern == "." || pattern == ".." ||
+		strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../")
+	if relative {
+		pattern = path.Join(filepath.ToSlash(relModDir), pattern)
+	}
+
+	expr := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\.\.\.`, `.*`)
+	if prefix, ok := strings.CutSuffix(expr, `/.*`); ok {
+		expr = prefix + `(/.*)?`
+	}
+	re := regexp.MustCompile(`^` + expr + `$`)
+
+	return func(pkg Package) bool {
+		if relative {
+			return re.MatchString(filepath.ToSlash(pkg.Dir))
+		}
+		return re.MatchString(pkg.PkgPath)
+	}
+}
+
+// match slash separated paths against a glob, where * matches any sequence
+// of characters other than /, ? matches any single character other than /,
+// and ** matches any sequence of characters, including /. A **/ prefix or
+// /** suffix also match nothing.
+func matchGlob(glob string) func(string) bool {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString(`(.*/)?`)
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			expr.WriteString(`(/.*)?`)
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(`.*`)
+			i++
+		case glob[i] == '*':
+			expr.WriteString(`[^/]*`)
+		case glob[i] == '?':
+			expr.WriteString(`[^/]`)
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return regexp.MustCompile(`^` + expr.String() + `$`).MatchString
+}
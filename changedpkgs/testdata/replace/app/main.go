@@ -0,0 +1,9 @@
+package main
+
+import (
+	_ "example.com/lib"
+
+	_ "example.com/app/other"
+)
+
+func main() {}
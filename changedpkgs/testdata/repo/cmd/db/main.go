@@ -1,6 +1,8 @@
 package main
 
 import (
+	_ "golang.org/x/term"
+
 	_ "example.com/test-repo/internal/sql"
 )
 
@@ -5,5 +5,6 @@ go 1.21.0
 require (
 	golang.org/x/mod v0.13.0
 	golang.org/x/sys v0.14.0
+	golang.org/x/term v0.14.0
 	golang.org/x/time v0.4.0
 )
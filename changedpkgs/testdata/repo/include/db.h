@@ -0,0 +1 @@
+static int db_version() { return 1; }
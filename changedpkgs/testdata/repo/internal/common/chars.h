@@ -0,0 +1 @@
+static int db_is_space(char c) { return c == 0x20; }
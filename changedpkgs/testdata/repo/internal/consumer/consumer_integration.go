@@ -0,0 +1,7 @@
+//go:build integration
+
+package consumer
+
+import (
+	_ "example.com/test-repo/internal/sql"
+)
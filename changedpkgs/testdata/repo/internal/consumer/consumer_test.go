@@ -0,0 +1,10 @@
+package consumer_test
+
+import (
+	"testing"
+
+	_ "example.com/test-repo/internal/consumer"
+	_ "example.com/test-repo/internal/sql"
+)
+
+func TestConsumer(t *testing.T) {}
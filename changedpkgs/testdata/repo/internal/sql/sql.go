@@ -0,0 +1,13 @@
+package sql
+
+// #cgo CFLAGS: -I${SRCDIR}/../../include
+// #include <db.h>
+// #include "../common/strings.h"
+import "C"
+
+import (
+	"embed"
+)
+
+//go:embed *.sql
+var fs embed.FS
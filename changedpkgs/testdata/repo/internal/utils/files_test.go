@@ -0,0 +1,5 @@
+package utils
+
+import "testing"
+
+func TestUtils(t *testing.T) {}
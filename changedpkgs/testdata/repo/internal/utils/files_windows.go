@@ -0,0 +1,5 @@
+package utils
+
+import (
+	_ "golang.org/x/sys/windows"
+)
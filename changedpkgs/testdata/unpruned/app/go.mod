@@ -0,0 +1,5 @@
+module example.com/app
+
+go 1.16
+
+require golang.org/x/term v0.14.0
@@ -0,0 +1,7 @@
+package main
+
+import (
+	_ "golang.org/x/term"
+)
+
+func main() {}
@@ -0,0 +1,5 @@
+module example.com/dep
+
+go 1.16
+
+require golang.org/x/sys v0.15.0
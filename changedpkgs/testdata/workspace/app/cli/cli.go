@@ -0,0 +1,5 @@
+package cli
+
+import (
+	_ "example.com/lib"
+)
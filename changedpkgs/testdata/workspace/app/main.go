@@ -0,0 +1,8 @@
+package main
+
+import (
+	_ "example.com/app/cli"
+	_ "example.com/lib"
+)
+
+func main() {}
@@ -0,0 +1,5 @@
+package strs
+
+import (
+	_ "strings"
+)
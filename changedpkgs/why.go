@@ -0,0 +1,63 @@
+package changedpkgs
+
+import "slices"
+
+// Chain is a chain of imports from a package to the change affecting it.
+type Chain struct {
+	// import paths of changed packages, starting from the package asked about,
+	// where each imports the next
+	Packages []string
+	// the changed file, relative to the repo, belonging to the last package.
+	// Unset if the last package is changed by a module instead
+	File string
+	// the changed module the last package imports packages from. Unset if
+	// the last package is changed by a file instead
+	Module string
+}
+
+// Why finds the shortest chain of imports from the package `pkgPath` back to
+// a changed file or module causing it to be changed, similar to
+// `go mod why`. Returns false if the package isn't changed.
+func (r Result) Why(pkgPath string) (Chain, bool) {
+	byPath := make(map[string]Reasons, len(r.Packages)+len(r.unreported))
+	for _, pkg := range slices.Concat(r.Packages, r.unreported) {
+		byPath[pkg.PkgPath] = pkg.Reasons
+	}
+
+	// breadth first search, tracking the package we came from to build the
+	// chain once we find a direct change
+	previous := map[string]string{pkgPath: ""}
+	queue := []string{pkgPath}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		reasons := byPath[current]
+		if len(reasons.Files) > 0 || len(reasons.Modules) > 0 {
+			var chain Chain
+			for pkg := current; pkg != pkgPath; pkg = previous[pkg] {
+				chain.Packages = append(chain.Packages, pkg)
+			}
+			chain.Packages = append(chain.Packages, pkgPath)
+			slices.Reverse(chain.Packages)
+
+			if len(reasons.Files) > 0 {
+				chain.File = reasons.Files[0]
+			} else {
+				chain.Module = reasons.Modules[0]
+			}
+			return chain, true
+		}
+
+		for _, dep := range reasons.Dependencies {
+			if _, ok := previous[dep]; ok {
+				continue
+			}
+			previous[dep] = current
+			queue = append(queue, dep)
+		}
+	}
+
+	// only reachable when `pkgPath` isn't changed
+	return Chain{}, false
+}
@@ -2,23 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"slices"
 	"strings"
 
 	"github.com/urfave/cli/v2"
 	"gitlab.com/matthewhughes/signalctx"
 	"gitlab.com/matthewhughes/slogctx"
-	"golang.org/x/exp/maps"
-	"golang.org/x/mod/modfile"
-	"golang.org/x/tools/go/packages"
 
+	"github.com/utilitywarehouse/go-changed-pkgs/changedpkgs"
 	"github.com/utilitywarehouse/go-changed-pkgs/internal/flag"
 )
 
@@ -30,6 +26,36 @@ const (
 	_sigIntVal      = 2
 )
 
+// values for --affected.
+const (
+	_affectedAll   = "all"
+	_affectedBuild = "build"
+	_affectedTests = "tests"
+)
+
+// the default for --config.
+const _defaultConfigPath = ".go-changed-pkgs.yaml"
+
+// values for --kind.
+const (
+	_kindAll  = "all"
+	_kindMain = "main"
+	_kindLib  = "lib"
+)
+
+// values for --format.
+const (
+	_formatText = "text"
+	_formatJSON = "json"
+)
+
+// values for --print.
+const (
+	_printPackage = "package"
+	_printDir     = "dir"
+	_printBinary  = "binary"
+)
+
 func main() { //go-cov:skip
 	app := buildApp(os.Stdout)
 	exitCode, err := runApp(context.Background(), app, os.Args)
@@ -52,11 +78,56 @@ func runApp(ctx context.Context, app *cli.App, args []string) (int, error) {
 
 func buildApp(out io.Writer) *cli.App {
 	var (
-		repoDir string
-		modDir  string
-		fromRef string
-		toRef   string
+		repoDir         string
+		modDir          string
+		fromRef         string
+		toRef           string
+		includeTestDeps bool
+		workspace       bool
+		staged          bool
+		mergeBase       bool
+		configPath      string
+		dirFiles        bool
 	)
+	affectedValue := flag.NewChoiceValue(_affectedAll, _affectedAll, _affectedBuild, _affectedTests)
+	kindValue := flag.NewChoiceValue(_kindAll, _kindAll, _kindMain, _kindLib)
+	formatValue := flag.NewChoiceValue(_formatText, _formatText, _formatJSON)
+	printValue := flag.NewChoiceValue(_printPackage, _printPackage, _printDir, _printBinary)
+	orderValue := flag.NewChoiceValue(
+		string(changedpkgs.OrderLexical),
+		string(changedpkgs.OrderLexical),
+		string(changedpkgs.OrderTopological),
+	)
+	goVersionChangesValue := flag.NewChoiceValue(
+		string(changedpkgs.GoVersionChangesAll),
+		string(changedpkgs.GoVersionChangesAll),
+		string(changedpkgs.GoVersionChangesStdlib),
+		string(changedpkgs.GoVersionChangesNone),
+	)
+	getOptions := func(cCtx *cli.Context) changedpkgs.Options {
+		goVersionChanges := cCtx.Value("go-version-changes").(string) //nolint:errcheck
+		order := cCtx.Value("order").(string)                         //nolint:errcheck
+		return changedpkgs.Options{
+			RepoDir:          repoDir,
+			ModDir:           modDir,
+			FromRef:          fromRef,
+			ToRef:            toRef,
+			Staged:           staged,
+			MergeBase:        mergeBase,
+			Workspace:        workspace,
+			IncludeTestDeps:  includeTestDeps,
+			GoVersionChanges: changedpkgs.GoVersionChanges(goVersionChanges),
+			Order:            changedpkgs.Order(order),
+			Patterns:         cCtx.StringSlice("pattern"),
+			Exclude:          cCtx.StringSlice("exclude"),
+			ConfigPath:       configPath,
+			ConfigOptional:   !cCtx.IsSet("config"),
+			DirFiles:         dirFiles,
+			DirFilesIgnore:   cCtx.StringSlice("dir-files-ignore"),
+			Tags:             cCtx.StringSlice("tags"),
+			Platforms:        cCtx.StringSlice("platforms"),
+		}
+	}
 
 	return &cli.App{
 		Name:  "changed-go-packages",
@@ -70,7 +141,19 @@ func buildApp(out io.Writer) *cli.App {
 			&cli.StringFlag{
 				Name:        "to-ref",
 				Destination: &toRef,
-				Required:    true,
+				Usage: "The ref to compare --from-ref against. If unset, --from-ref is compared against " +
+					"the working tree, including untracked files",
+			},
+			&cli.BoolFlag{
+				Name:        "staged",
+				Destination: &staged,
+				Usage:       "Without --to-ref, compare --from-ref against the index rather than the working tree",
+			},
+			&cli.BoolFlag{
+				Name:        "merge-base",
+				Destination: &mergeBase,
+				Usage: "Compare against the merge base of --from-ref and --to-ref (or HEAD, without --to-ref), " +
+					"like git diff from...to, so only changes since the branch forked are included",
 			},
 			&cli.StringFlag{
 				Name:        "repo-dir",
@@ -82,335 +165,270 @@ func buildApp(out io.Writer) *cli.App {
 				Name:        "mod-dir",
 				Destination: &modDir,
 				Value:       ".",
-				Usage:       "Path to the directory containing go.mod. Used to find local packages",
+				Usage:       "Path to the directory containing go.mod, inside --repo-dir. Used to find local packages at the version compared against",
+			},
+			&cli.StringFlag{
+				Name:        "config",
+				Destination: &configPath,
+				Value:       _defaultConfigPath,
+				Usage: "Path to a config file, relative to --repo-dir, mapping globs of files to the " +
+					"packages they change. A relative path is read at the version compared against. " +
+					"Ignored if it doesn't exist and wasn't set explicitly",
+			},
+			&cli.BoolFlag{
+				Name:        "dir-files",
+				Destination: &dirFiles,
+				Usage: "Consider any file in a package's directory, or in a subdirectory that isn't " +
+					"itself a package's directory, part of the package",
+			},
+			&cli.StringSliceFlag{
+				Name: "dir-files-ignore",
+				Usage: "A glob of files, relative to --repo-dir, to leave out with --dir-files. " +
+					"Globs without a / match the file name in any directory. Can be repeated",
+			},
+			&cli.BoolFlag{
+				Name:        "workspace",
+				Destination: &workspace,
+				Usage: "Load packages from every module in the Go workspace containing --mod-dir, " +
+					"or if there's no go.work, from every module under --mod-dir",
+			},
+			&cli.StringSliceFlag{
+				Name: "pattern",
+				Usage: "A package pattern, as accepted by go list and relative to --mod-dir, " +
+					"selecting packages to load and output. Can be repeated. Defaults to all packages " +
+					"in the module or workspace. Changes still propagate through other local packages " +
+					"the selected packages import. Meta patterns like all aren't supported",
+			},
+			&cli.StringSliceFlag{
+				Name: "exclude",
+				Usage: "A package pattern, like --pattern, for packages to leave out of the output. " +
+					"Can be repeated. Changes still propagate through these packages",
+			},
+			&cli.StringSliceFlag{
+				Name:  "tags",
+				Usage: "Build tags to load packages with. Can be repeated or comma separated",
+			},
+			&cli.StringSliceFlag{
+				Name: "platforms",
+				Usage: "Platforms, as GOOS/GOARCH, to load packages for, outputting packages changed " +
+					"for any of them. Can be repeated or comma separated. Defaults to the host platform",
+			},
+			&cli.BoolFlag{
+				Name:        "include-test-deps",
+				Destination: &includeTestDeps,
+				Usage:       "Also consider packages changed when their tests import a changed package",
+			},
+			&cli.GenericFlag{
+				Name:  "affected",
+				Value: affectedValue,
+				Usage: affectedValue.Usage(
+					"Which changed packages to output: all of them, only those whose build is affected, " +
+						"or only those where just the tests are affected",
+				),
+			},
+			&cli.GenericFlag{
+				Name:  "kind",
+				Value: kindValue,
+				Usage: kindValue.Usage(
+					"Which kind of changed packages to output: all of them, only main packages (i.e. commands), " +
+						"or only libraries",
+				),
+			},
+			&cli.GenericFlag{
+				Name:  "go-version-changes",
+				Value: goVersionChangesValue,
+				Usage: goVersionChangesValue.Usage(
+					"Which packages to consider changed when the go or toolchain version in go.mod or go.work changes: " +
+						"the module's packages (all local packages for go.work), only those importing the " +
+						"standard library, or none",
+				),
+			},
+			&cli.GenericFlag{
+				Name:  "format",
+				Value: formatValue,
+				Usage: formatValue.Usage(
+					"How to output changed packages: their import paths one per line, " +
+						"or as a JSON object including the reasons each package changed " +
+						"and any packages that were removed",
+				),
+			},
+			&cli.GenericFlag{
+				Name:  "print",
+				Value: printValue,
+				Usage: printValue.Usage(
+					"What to print for each changed package with the text format: its import path, " +
+						"its directory relative to the repo, or the name of the binary go build would " +
+						"produce for it",
+				),
+			},
+			&cli.GenericFlag{
+				Name:  "order",
+				Value: orderValue,
+				Usage: orderValue.Usage(
+					"How to order changed packages: by import path, " +
+						"or with packages after the local packages they import",
+				),
 			},
 			flag.NewSlogLevelValueFlag(),
 		},
+		Commands: []*cli.Command{
+			{
+				Name:      "why",
+				Usage:     "Print the shortest chain of imports from a package to the change that affects it",
+				ArgsUsage: "<package>",
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return fmt.Errorf("expected a single package argument, got %d", cCtx.NArg())
+					}
+					return printWhy(
+						contextWithLogger(cCtx),
+						out,
+						getOptions(cCtx),
+						cCtx.Args().First(),
+					)
+				},
+			},
+		},
 		Action: func(cCtx *cli.Context) error {
-			logLvl := cCtx.Value("log-level").(slog.Level) //nolint:errcheck
-			logger := slog.New(
-				slog.NewTextHandler(
-					os.Stderr,
-					&slog.HandlerOptions{Level: logLvl},
-				),
+			return printChangedPackages(
+				contextWithLogger(cCtx),
+				out,
+				getOptions(cCtx),
+				outputOptions{
+					affected: cCtx.Value("affected").(string), //nolint:errcheck
+					kind:     cCtx.Value("kind").(string),     //nolint:errcheck
+					format:   cCtx.Value("format").(string),   //nolint:errcheck
+					print:    cCtx.Value("print").(string),    //nolint:errcheck
+				},
 			)
-			ctx := slogctx.WithLogger(cCtx.Context, logger)
-			return printChangedPackages(ctx, out, repoDir, modDir, fromRef, toRef)
 		},
 	}
 }
 
-func printChangedPackages(
-	ctx context.Context,
-	out io.Writer,
-	repoDir string,
-	modDir string,
-	fromRef string,
-	toRef string,
-) error {
-	packages, err := getChangedPackages(
-		ctx,
-		repoDir,
-		modDir,
-		fromRef,
-		toRef,
+func contextWithLogger(cCtx *cli.Context) context.Context {
+	logLvl := cCtx.Value("log-level").(slog.Level) //nolint:errcheck
+	logger := slog.New(
+		slog.NewTextHandler(
+			os.Stderr,
+			&slog.HandlerOptions{Level: logLvl},
+		),
 	)
-	if err != nil {
-		return fmt.Errorf("getting changed packages: %w", err)
-	}
+	return slogctx.WithLogger(cCtx.Context, logger)
+}
 
-	for _, pkg := range packages {
-		fmt.Fprintln(out, pkg)
-	}
-	return nil
+// how to filter and print changed packages.
+type outputOptions struct {
+	affected string
+	kind     string
+	format   string
+	print    string
 }
 
-// get packages that are changed between `fromRef` and `toRef`, where 'changed'
-// means:
-//
-//   - The package contains a file that was changed between the two SHAs
-//   - The package imports a package from a 3rd party module that was changed between the to SHAs
-//   - The package imports a local package for which either of the above holds
-func getChangedPackages(
+func printChangedPackages(
 	ctx context.Context,
-	repoDir string,
-	modDir string,
-	fromRef string,
-	toRef string,
-) ([]string, error) {
-	pkgs, err := loadLocalPackages(ctx, modDir)
-	if err != nil {
-		return nil, err
-	}
-
-	// some bits require an absolute path, some don't. For simplicity just
-	// always use an absolute path
-	repoDir, err = filepath.Abs(repoDir)
-	if err != nil { //go-cov:skip // this is a bit of a hassle to test, and we don't really ever expect a failure
-		return nil, fmt.Errorf("failed building absolute path for %s: %w", repoDir, err)
-	}
-
-	changedFiles, err := getChangedFiles(ctx, repoDir, fromRef, toRef)
+	out io.Writer,
+	opts changedpkgs.Options,
+	outOpts outputOptions,
+) error {
+	result, err := changedpkgs.Get(ctx, opts)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("getting changed packages: %w", err)
 	}
-	slogctx.FromContext(ctx).Info("changed files", "files", changedFiles)
 
-	changedPackages, changedMods, err := collectChanges(
-		ctx,
-		changedFiles,
-		pkgs,
-		repoDir,
-		fromRef,
-		toRef,
-	)
-	if err != nil {
-		return nil, err
-	}
+	filtered := filterPackages(result.Packages, outOpts)
 
-	// relies on package's dependencies being before the package itself in the list
-	// this is guaranteed by `loadLocalPackages`
-	for _, pkg := range pkgs {
-		if _, ok := changedPackages[pkg.PkgPath]; ok {
-			continue
+	if outOpts.format == _formatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		result := changedpkgs.Result{
+			Packages: filtered,
+			Removed:  filterPackages(result.Removed, outOpts),
 		}
-		if isChangedFromImports(ctx, pkg.PkgPath, pkg.Imports, changedMods, changedPackages) {
-			changedPackages[pkg.PkgPath] = struct{}{}
+		if err := encoder.Encode(result); err != nil { //go-cov:skip // we don't really ever expect a failure
+			return fmt.Errorf("writing changed packages: %w", err)
 		}
+		return nil
 	}
 
-	return maps.Keys(changedPackages), nil
-}
-
-func loadLocalPackages(ctx context.Context, modDir string) ([]*packages.Package, error) {
-	loadCfg := packages.Config{
-		Context: ctx,
-		Mode: packages.NeedName |
-			packages.NeedFiles |
-			packages.NeedEmbedFiles |
-			// this runs `go list` with `-deps` which means
-			// "... a package is listed only after all its dependencies" (see the `go list` docs)
-			packages.NeedImports |
-			packages.NeedDeps |
-			// include the module: so we can map imports of 3rd party packages
-			// to a module
-
-			packages.NeedModule,
-		Dir: modDir,
-	}
-	pkgs, err := packages.Load(&loadCfg, "./...")
-	if err != nil {
-		return nil, fmt.Errorf("failed listing local packages: %w", err)
-	}
-
-	// early check for errors in packages, e.g. we can't load one because of a
-	// syntax error in the source
-	for _, pkg := range pkgs {
-		if len(pkg.Errors) != 0 {
-			return nil, fmt.Errorf("failed querying package %s: %v", pkg.PkgPath, pkg.Errors)
+	// removed packages can't be built or tested, so only list them in JSON
+	for _, pkg := range filtered {
+		switch outOpts.print {
+		case _printDir:
+			fmt.Fprintln(out, pkg.Dir)
+		case _printBinary:
+			fmt.Fprintln(out, binaryName(pkg.PkgPath))
+		default:
+			fmt.Fprintln(out, pkg.PkgPath)
 		}
 	}
-
-	return pkgs, nil
-}
-
-func getChangedFiles(
-	ctx context.Context,
-	repoDir string,
-	fromRef string,
-	toRef string,
-) ([]string, error) {
-	out, err := runGitCmd(ctx, "-C", repoDir, "diff", "--name-only", "-z", fromRef, toRef)
-	if err != nil {
-		return nil, fmt.Errorf("listing changed files: %w", err)
-	}
-
-	// there's always a trailing '\x00' so trim that element
-	return strings.Split(strings.TrimSuffix(out, "\x00"), "\x00"), nil
+	return nil
 }
 
-func collectChanges(
-	ctx context.Context,
-	changedFiles []string,
-	pkgs []*packages.Package,
-	repoDir string,
-	fromRef string,
-	toRef string,
-) (map[string]struct{}, map[string]struct{}, error) {
-	changedPackages := map[string]struct{}{}
-	changedMods := map[string]struct{}{}
-	var err error
-
-	for _, path := range changedFiles {
-		if filepath.Base(path) == "go.mod" {
-			changedMods, err = getChangedMods(ctx, path, repoDir, fromRef, toRef)
-			if err != nil {
-				return nil, nil, err
-			}
-			slogctx.FromContext(ctx).Info("changed 3rd party modules", "modules", changedMods)
+func filterPackages(pkgs []changedpkgs.Package, outOpts outputOptions) []changedpkgs.Package {
+	filtered := make([]changedpkgs.Package, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		if outOpts.affected == _affectedBuild && pkg.TestsOnly ||
+			outOpts.affected == _affectedTests && !pkg.TestsOnly {
+			continue
 		}
-
-		for _, pkg := range pkgs {
-			if fileInPkg(pkg, repoDir, path) {
-				slogctx.FromContext(ctx).Debug(
-					"package detected changed because of file",
-					"package",
-					pkg.PkgPath,
-					"file",
-					path,
-				)
-				changedPackages[pkg.PkgPath] = struct{}{}
-				// a file shouldn't belong to more than one package
-				break
-			}
+		if outOpts.kind == _kindMain && pkg.Name != "main" ||
+			outOpts.kind == _kindLib && pkg.Name == "main" {
+			continue
 		}
+		filtered = append(filtered, pkg)
 	}
-
-	return changedPackages, changedMods, nil
+	return filtered
 }
 
-func getChangedMods(
-	ctx context.Context,
-	modPath string,
-	repoDir string,
-	fromRef string,
-	toRef string,
-) (map[string]struct{}, error) {
-	curModFile, oldModFile, err := readModFiles(ctx, repoDir, modPath, fromRef, toRef)
-	if err != nil {
-		return nil, err
-	}
-
-	changedMods := map[string]struct{}{}
-	// we're not interested in modules that existed in the old go.mod
-	// but not the current one, since no packages should currently
-	// depend on them
-	oldModMap := map[string]*modfile.Require{}
-	for _, req := range oldModFile.Require {
-		oldModMap[req.Mod.Path] = req
-	}
-
-	for _, req := range curModFile.Require {
-		if old, ok := oldModMap[req.Mod.Path]; ok {
-			if req.Mod.Version != old.Mod.Version {
-				changedMods[req.Mod.Path] = struct{}{}
-			}
-		}
+// get the name of the binary `go build` or `go install` produces for the
+// main package with import path `pkgPath`: the last element of the path,
+// unless that's a major version suffix like v2 (but not v0 or v1, which
+// can't be used as suffixes).
+func binaryName(pkgPath string) string {
+	elems := strings.Split(pkgPath, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && isMajorVersion(name) {
+		return elems[len(elems)-2]
 	}
-
-	return changedMods, nil
+	return name
 }
 
-func readModFiles(
-	ctx context.Context,
-	repoDir string,
-	modPath string,
-	fromRef string,
-	toRef string,
-) (*modfile.File, *modfile.File, error) {
-	oldModFile, err := readModFileAtRef(ctx, repoDir, modPath, fromRef)
-	if err != nil {
-		return nil, nil, err
+func isMajorVersion(elem string) bool {
+	digits, ok := strings.CutPrefix(elem, "v")
+	if !ok || digits == "" || digits[0] == '0' || digits == "1" {
+		return false
 	}
-	newModFile, err := readModFileAtRef(ctx, repoDir, modPath, toRef)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return newModFile, oldModFile, nil
+	return strings.Trim(digits, "0123456789") == ""
 }
 
-func readModFileAtRef(
+// print the shortest chain of imports from the package `pkgPath` back to a
+// changed file or module causing it to be changed, similar to `go mod why`.
+func printWhy(
 	ctx context.Context,
-	repoDir string,
-	modPath string,
-	ref string,
-) (*modfile.File, error) {
-	modData, err := runGitCmd(
-		ctx,
-		"-C",
-		repoDir,
-		"show",
-		fmt.Sprintf("%s:%s", ref, modPath),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("reading %s at %s: %w", modPath, ref, err)
-	}
-	modFile, err := modfile.Parse(modPath, []byte(modData), nil)
+	out io.Writer,
+	opts changedpkgs.Options,
+	pkgPath string,
+) error {
+	result, err := changedpkgs.Get(ctx, opts)
 	if err != nil {
-		return nil, fmt.Errorf("parsing mod file %s at %s: %w", modPath, ref, err)
+		return fmt.Errorf("getting changed packages: %w", err)
 	}
-	return modFile, nil
-}
 
-func fileInPkg(pkg *packages.Package, repoDir string, path string) bool {
-	// packages.Package uses absolute paths for files
-	absPath := filepath.Join(repoDir, path)
-
-	return slices.Contains(pkg.GoFiles, absPath) ||
-		slices.Contains(pkg.OtherFiles, absPath) ||
-		slices.Contains(pkg.EmbedFiles, absPath)
-}
-
-func isChangedFromImports(
-	ctx context.Context,
-	pkgPath string,
-	imports map[string]*packages.Package,
-	changedMods map[string]struct{},
-	changedPackages map[string]struct{},
-) bool {
-	for importPath, importPkg := range imports {
-		if _, ok := changedPackages[importPath]; ok {
-			slogctx.FromContext(ctx).Debug(
-				"package detected changed because of dependent package",
-				"package",
-				pkgPath,
-				"dependency",
-				importPath,
-			)
-			return true
-		}
-		mod := importPkg.Module
-		if mod != nil {
-			if _, ok := changedMods[mod.Path]; ok {
-				slogctx.FromContext(ctx).Debug(
-					"package detected changed because of dependent 3rd party module",
-					"package",
-					pkgPath,
-					"module",
-					mod.Path,
-				)
-				return true
-			}
-		}
+	fmt.Fprintf(out, "# %s\n", pkgPath)
+	chain, ok := result.Why(pkgPath)
+	if !ok {
+		fmt.Fprintf(out, "(package %s is not changed)\n", pkgPath)
+		return nil
 	}
-	return false
-}
-
-// A convenience func for running commands.
-// Upon success returns the string written from the command's stdout.
-// Upton failure returns an error include details from the command's stderr.
-func runCmd(cmd *exec.Cmd) (string, error) {
-	var stdout strings.Builder
-	var stderr strings.Builder
-
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf(
-			"running command: `%s`: %w\nstderr: %s",
-			strings.Join(cmd.Args, " "),
-			err,
-			stderr.String(),
-		)
+	for _, pkg := range chain.Packages {
+		fmt.Fprintln(out, pkg)
 	}
-
-	return stdout.String(), nil
-}
-
-func runGitCmd(ctx context.Context, args ...string) (string, error) {
-	return runCmd(exec.CommandContext(ctx, "git", args...))
+	if chain.File != "" {
+		fmt.Fprintln(out, "changed file: "+chain.File)
+	} else {
+		fmt.Fprintln(out, "changed module: "+chain.Module)
+	}
+	return nil
 }
 
 func getAppStatus(ctx context.Context, err error) (int, error) {
@@ -3,356 +3,810 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
-	"gopkg.in/yaml.v3"
-)
 
-var (
-	// args to be copied for tests, just contains a placeholder for os.Args[0].
-	progArgs = []string{"prog-name"}
+	"github.com/utilitywarehouse/go-changed-pkgs/changedpkgs"
+	"github.com/utilitywarehouse/go-changed-pkgs/internal/testrepo"
+)
 
-	// path to the test module.
-	modPath = filepath.Join("cmd", "testdata", "repo")
+// these tests cover the CLI itself, the detection of changed packages is
+// tested in the changedpkgs package, using the same testdata.
 
-	// mutex to avoid concurrent `git worktree` commands.
-	worktreeMutex sync.Mutex
-)
+// args to be copied for tests, just contains a placeholder for os.Args[0].
+var progArgs = []string{"prog-name"}
 
 // the name of the test module.
 const testModuleName = "example.com/test-repo"
 
-// map of patch name -> expected changed packages.
-type testCfg map[string][]string
-
-// some of these tests run based off testdata containing:
-//
-//   - a test module with some basic Go files
-//   - a set of patches to be applied to the files in this module,
-//     and the expected changed outout
-//
-// load these configs from: testdata/repo/patches/config.yaml.
-func loadTestConfigs(t *testing.T) testCfg {
-	t.Helper()
-	configPath := filepath.Join(getPatchesPath(t), "config.yaml")
-	data, err := os.ReadFile(configPath)
-	require.NoError(t, err)
-
-	configs := make(testCfg)
-	require.NoError(t, yaml.Unmarshal(data, &configs))
-
-	for _, expectedRelPkgs := range configs {
-		// for simplicity, config.yaml just contains relative package paths,
-		// so add back the module name to these to get complete package paths
-		for i, pkg := range expectedRelPkgs {
-			expectedRelPkgs[i] = testModuleName + pkg
-		}
-	}
-
-	return configs
-}
-
-// run tests in a new worktree to avoid polluting the current repo,
-// also lets us parallelise.
-func setupWorktree(t *testing.T, name string) string {
+func runWithPatches(
+	t *testing.T,
+	worktreePath string,
+	patchNames []string,
+	buf io.Writer,
+	extraArgs ...string,
+) error {
 	t.Helper()
-	worktreePath := filepath.Join(t.TempDir(), name)
-
-	worktreeMutex.Lock()
-	defer worktreeMutex.Unlock()
-	// --detach to avoid creating a new branch in the current repo
-	mustRunGitCmd(t, "worktree", "add", "--quiet", "--detach", worktreePath)
-	t.Cleanup(func() {
-		// try to cleanup the worktree, just to be polite
-		// but the TempDir should be deleted at the end of the test run regardless
-		if _, err := runGitCmd(context.Background(), "worktree", "remove", "--force", worktreePath); err != nil {
-			t.Logf(
-				"failed to remove worktree at %s (you may want to manually remove it): %v",
-				worktreePath,
-				err,
-			)
-		}
-	})
-
-	return worktreePath
+	return runModuleWithPatches(t, worktreePath, "repo", patchNames, buf, extraArgs...)
 }
 
-func getPatchesPath(t *testing.T) string {
+// like runWithPatches, but for the workspace under testdata/workspace.
+func runWorkspaceWithPatches(
+	t *testing.T,
+	worktreePath string,
+	patchNames []string,
+	buf io.Writer,
+	extraArgs ...string,
+) error {
 	t.Helper()
-	patchesPath, err := filepath.Abs(filepath.Join("testdata", "repo", "patches"))
-	require.NoError(t, err)
-	return patchesPath
+	return runModuleWithPatches(
+		t,
+		worktreePath,
+		"workspace",
+		patchNames,
+		buf,
+		append([]string{"--workspace"}, extraArgs...)...,
+	)
 }
 
-func runWithPatches(t *testing.T, worktreePath string, patchNames []string, buf io.Writer) error {
+// like runWithPatches, but for the test module `module`, as for
+// [testrepo.ModDir].
+func runModuleWithPatches(
+	t *testing.T,
+	worktreePath string,
+	module string,
+	patchNames []string,
+	buf io.Writer,
+	extraArgs ...string,
+) error {
 	t.Helper()
-	modDir := filepath.Join(worktreePath, modPath)
-
-	prePatchHead, postPatchHead := commitPatches(t, worktreePath, patchNames...)
+	prePatchHead, postPatchHead := testrepo.CommitModulePatches(t, worktreePath, module, patchNames...)
 
 	args := append( //nolint:gocritic
 		progArgs,
 		"--repo-dir",
 		worktreePath,
 		"--mod-dir",
-		modDir,
+		testrepo.ModDir(worktreePath, module),
 		"--from-ref",
 		prePatchHead,
 		"--to-ref",
 		postPatchHead,
 	)
+	args = append(args, extraArgs...)
 	app := buildTestApp(buf)
 	_, err := runApp(context.Background(), app, args)
 	return err
 }
 
-func TestWithSingleCommit(t *testing.T) {
+func TestAffected(t *testing.T) {
 	t.Parallel()
-	configs := loadTestConfigs(t)
 
-	for name, expected := range configs {
-		worktreeName := "patch-test-" + name
-		t.Run(name, func(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		patch    string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "test imports ignored by default",
+			patch:    "change-in-embedded-file.patch",
+			expected: []string{"/internal/sql", "/cmd/db"},
+		},
+		{
+			name:     "test imports included",
+			patch:    "change-in-embedded-file.patch",
+			args:     []string{"--include-test-deps"},
+			expected: []string{"/internal/sql", "/cmd/db", "/internal/consumer"},
+		},
+		{
+			name:     "only build affected",
+			patch:    "change-in-embedded-file.patch",
+			args:     []string{"--include-test-deps", "--affected", "build"},
+			expected: []string{"/internal/sql", "/cmd/db"},
+		},
+		{
+			name:     "only tests affected",
+			patch:    "change-in-embedded-file.patch",
+			args:     []string{"--include-test-deps", "--affected", "tests"},
+			expected: []string{"/internal/consumer"},
+		},
+		{
+			name:     "test file change doesn't affect build",
+			patch:    "change-in-test-file.patch",
+			args:     []string{"--affected", "build"},
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 			var buf bytes.Buffer
 
-			err := runWithPatches(t, setupWorktree(t, worktreeName), []string{name}, &buf)
+			err := runWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				&buf,
+				tc.args...,
+			)
 
 			require.NoError(t, err)
-			compareResults(t, expected, buf)
+			compareResults(t, addModuleName(tc.expected), buf)
 		})
 	}
 }
 
-func TestToShaNotHead(t *testing.T) {
+func TestFilters(t *testing.T) {
 	t.Parallel()
-	configs := loadTestConfigs(t)
 
-	// for simplicity: patches with non-intersecting expected changed files
-	patchesForCommit := []string{
-		"change-in-top-level-package.patch",
-		"change-in-embedded-file.patch",
-	}
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "only main packages",
+			args:     []string{"--kind", "main"},
+			expected: []string{testModuleName, testModuleName + "/cmd/db"},
+		},
+		{
+			name: "only libraries",
+			args: []string{"--kind", "lib"},
+			expected: []string{
+				testModuleName + "/internal/consumer",
+				testModuleName + "/internal/utils",
+				testModuleName + "/internal/sql",
+			},
+		},
+		{
+			name: "print directories",
+			args: []string{"--kind", "main", "--print", "dir"},
+			expected: []string{
+				"changedpkgs/testdata/repo",
+				"changedpkgs/testdata/repo/cmd/db",
+			},
+		},
+		{
+			name:     "print binaries",
+			args:     []string{"--kind", "main", "--print", "binary"},
+			expected: []string{"test-repo", "db"},
+		},
+		{
+			name: "patterns",
+			args: []string{"--pattern", "./cmd/...", "--pattern", "."},
+			expected: []string{
+				testModuleName,
+				testModuleName + "/cmd/db",
+			},
+		},
+		{
+			name: "excluded",
+			args: []string{"--exclude", "./internal/...", "--exclude", "./cmd/..."},
+			expected: []string{
+				testModuleName,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+
+			err := runWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				// changes every package
+				[]string{"bump-go-version.patch"},
+				&buf,
+				tc.args...,
+			)
 
-	expected := []string{}
-	for _, name := range patchesForCommit {
-		expected = append(expected, configs[name]...)
+			require.NoError(t, err)
+			compareResults(t, tc.expected, buf)
+		})
 	}
+}
 
-	worktreeName := "changed-test-many-commits"
-	worktreePath := setupWorktree(t, worktreeName)
-	modDir := filepath.Join(worktreePath, modPath)
-	prePatchHead, postPatchHead := commitPatches(t, worktreePath, patchesForCommit...)
+func TestBuildConfigs(t *testing.T) {
+	t.Parallel()
 
-	// add extra commit so HEAD != toSHA
-	commitPatches(t, worktreePath, "upgrade-top-level-dependency.patch")
+	for _, tc := range []struct {
+		name     string
+		patch    string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "tags",
+			patch:    "change-in-embedded-file.patch",
+			args:     []string{"--tags", "integration"},
+			expected: []string{"", "/cmd/db", "/internal/consumer", "/internal/sql"},
+		},
+		{
+			name:     "platforms",
+			patch:    "add-windows-package.patch",
+			args:     []string{"--platforms", "windows/amd64"},
+			expected: []string{"/internal/winutil"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
 
-	var buf bytes.Buffer
-	args := append( //nolint:gocritic
-		progArgs,
-		"--repo-dir",
-		worktreePath,
-		"--mod-dir",
-		modDir,
-		"--from-ref",
-		prePatchHead,
-		"--to-ref",
-		postPatchHead,
-	)
-	app := buildTestApp(&buf)
-	retCode, err := runApp(context.Background(), app, args)
-	require.NoError(t, err)
-	require.Equal(t, 0, retCode)
-	compareResults(t, expected, buf)
+			err := runWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				&buf,
+				tc.args...,
+			)
+
+			require.NoError(t, err)
+			compareResults(t, addModuleName(tc.expected), buf)
+		})
+	}
 }
 
-func TestRelativeRepoAndModDirs(t *testing.T) {
+func TestBinaryName(t *testing.T) {
 	t.Parallel()
-	configs := loadTestConfigs(t)
-	patchName := "change-in-top-level-package.patch"
-	expected := configs[patchName]
 
-	absWorktreePath := setupWorktree(t, "changed-test-relative-paths")
-	cwd, err := os.Getwd()
-	require.NoError(t, err)
-	worktreePath, err := filepath.Rel(cwd, absWorktreePath)
-	require.NoError(t, err)
-	modDir := filepath.Join(worktreePath, modPath)
+	for pkgPath, expected := range map[string]string{
+		"example.com/cmd/tool":    "tool",
+		"example.com/cmd/tool/v2": "tool",
+		"example.com/tool/v1":     "v1",
+		"example.com/tool/v02":    "v02",
+		"example.com/tool/vx":     "vx",
+		"example.com/tool/v":      "v",
+		"tool":                    "tool",
+	} {
+		require.Equal(t, expected, binaryName(pkgPath), pkgPath)
+	}
+}
 
-	prePatchHead, postPatchHead := commitPatches(t, worktreePath, patchName)
+func TestWorkspaceOptions(t *testing.T) {
+	t.Parallel()
 
-	var buf bytes.Buffer
-	args := append( //nolint:gocritic
-		progArgs,
-		"--repo-dir",
-		worktreePath,
-		"--mod-dir",
-		modDir,
-		"--from-ref",
-		prePatchHead,
-		"--to-ref",
-		postPatchHead,
-	)
-	app := buildTestApp(&buf)
-	retCode, err := runApp(context.Background(), app, args)
-	require.NoError(t, err)
-	require.Equal(t, 0, retCode)
-	compareResults(t, expected, buf)
-}
+	for _, tc := range []struct {
+		name     string
+		patches  []string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "lexical order by default",
+			patches:  []string{"change-in-lib.patch"},
+			expected: []string{"example.com/app", "example.com/app/cli", "example.com/lib"},
+		},
+		{
+			name:     "topological order",
+			patches:  []string{"change-in-lib.patch"},
+			args:     []string{"--order", "topological"},
+			expected: []string{"example.com/lib", "example.com/app/cli", "example.com/app"},
+		},
+		{
+			name:     "toolchain changed only affecting stdlib importers",
+			patches:  []string{"add-work-toolchain.patch"},
+			args:     []string{"--go-version-changes", "stdlib"},
+			expected: []string{"example.com/lib/strs"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
 
-func compareResults(t *testing.T, expected []string, buf bytes.Buffer) {
-	t.Helper()
-	var gotLines []string
-	got := buf.String()
-	if got == "" {
-		gotLines = []string{}
-	} else {
-		gotLines = strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+			err := runWorkspaceWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				tc.patches,
+				&buf,
+				tc.args...,
+			)
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, getLines(buf))
+		})
 	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	t.Parallel()
 
-	require.ElementsMatch(t, expected, gotLines)
+	for _, tc := range []struct {
+		name            string
+		patch           string
+		args            []string
+		expected        []changedpkgs.Package
+		expectedRemoved []changedpkgs.Package
+	}{
+		{
+			name:  "changed file and dependencies",
+			patch: "change-in-embedded-file.patch",
+			args:  []string{"--include-test-deps"},
+			expected: []changedpkgs.Package{
+				{
+					PkgPath: "/internal/sql",
+					Name:    "sql",
+					Dir:     "changedpkgs/testdata/repo/internal/sql",
+					Status:  changedpkgs.StatusModified,
+					Reasons: changedpkgs.Reasons{
+						Files: []string{"changedpkgs/testdata/repo/internal/sql/migration.sql"},
+					},
+				},
+				{
+					PkgPath: "/cmd/db",
+					Name:    "main",
+					Dir:     "changedpkgs/testdata/repo/cmd/db",
+					Status:  changedpkgs.StatusModified,
+					Reasons: changedpkgs.Reasons{Dependencies: []string{"/internal/sql"}},
+				},
+				{
+					PkgPath:   "/internal/consumer",
+					Name:      "consumer",
+					Dir:       "changedpkgs/testdata/repo/internal/consumer",
+					Status:    changedpkgs.StatusModified,
+					TestsOnly: true,
+					Reasons:   changedpkgs.Reasons{Dependencies: []string{"/internal/sql"}},
+				},
+			},
+		},
+		{
+			name:  "respects affected",
+			patch: "change-in-embedded-file.patch",
+			args:  []string{"--include-test-deps", "--affected", "tests"},
+			expected: []changedpkgs.Package{
+				{
+					PkgPath:   "/internal/consumer",
+					Name:      "consumer",
+					Dir:       "changedpkgs/testdata/repo/internal/consumer",
+					Status:    changedpkgs.StatusModified,
+					TestsOnly: true,
+					Reasons:   changedpkgs.Reasons{Dependencies: []string{"/internal/sql"}},
+				},
+			},
+		},
+		{
+			name:  "changed module",
+			patch: "upgrade-first-level-dependency.patch",
+			expected: []changedpkgs.Package{
+				{
+					PkgPath: "/internal/consumer",
+					Name:    "consumer",
+					Dir:     "changedpkgs/testdata/repo/internal/consumer",
+					Status:  changedpkgs.StatusModified,
+					Reasons: changedpkgs.Reasons{Modules: []string{"golang.org/x/sys"}},
+				},
+				{
+					PkgPath: "",
+					Name:    "main",
+					Dir:     "changedpkgs/testdata/repo",
+					Status:  changedpkgs.StatusModified,
+					Reasons: changedpkgs.Reasons{Dependencies: []string{"/internal/consumer"}},
+				},
+				{
+					PkgPath: "/cmd/db",
+					Name:    "main",
+					Dir:     "changedpkgs/testdata/repo/cmd/db",
+					Status:  changedpkgs.StatusModified,
+					Reasons: changedpkgs.Reasons{Modules: []string{"golang.org/x/sys"}},
+				},
+			},
+		},
+		{
+			name:  "added and removed packages",
+			patch: "rename-package.patch",
+			expected: []changedpkgs.Package{
+				{
+					PkgPath: "/cmd/migrate",
+					Name:    "main",
+					Dir:     "changedpkgs/testdata/repo/cmd/migrate",
+					Status:  changedpkgs.StatusAdded,
+					Reasons: changedpkgs.Reasons{
+						Files: []string{"changedpkgs/testdata/repo/cmd/migrate/main.go"},
+					},
+				},
+			},
+			expectedRemoved: []changedpkgs.Package{
+				{
+					PkgPath: "/cmd/db",
+					Name:    "main",
+					Dir:     "changedpkgs/testdata/repo/cmd/db",
+					Status:  changedpkgs.StatusRemoved,
+					Reasons: changedpkgs.Reasons{
+						Files: []string{"changedpkgs/testdata/repo/cmd/db/main.go"},
+					},
+				},
+			},
+		},
+		{
+			name:  "removed packages respect affected",
+			patch: "rename-package.patch",
+			args:  []string{"--affected", "tests"},
+		},
+		{
+			name:  "nothing changed",
+			patch: "change-in-unrelated-file.patch",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			expected := changedpkgs.Result{
+				Packages: addModuleNameToPackages(tc.expected),
+				Removed:  addModuleNameToPackages(tc.expectedRemoved),
+			}
+			var buf bytes.Buffer
+
+			err := runWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				&buf,
+				append([]string{"--format", "json"}, tc.args...)...,
+			)
+			require.NoError(t, err)
+
+			var actual changedpkgs.Result
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &actual))
+			require.ElementsMatch(t, expected.Packages, actual.Packages)
+			require.Equal(t, expected.Removed, actual.Removed)
+		})
+	}
 }
 
-func commitPatches(t *testing.T, repoDir string, patchNames ...string) (string, string) {
-	t.Helper()
-	patchPaths := make([]string, 0, len(patchNames))
-	patchesPath := getPatchesPath(t)
-	for _, patchName := range patchNames {
-		patchPaths = append(patchPaths, filepath.Join(patchesPath, patchName))
+// add the test module's name to the relative package paths in `pkgs`.
+func addModuleNameToPackages(pkgs []changedpkgs.Package) []changedpkgs.Package {
+	named := make([]changedpkgs.Package, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		pkg.PkgPath = testModuleName + pkg.PkgPath
+		for i, dep := range pkg.Reasons.Dependencies {
+			pkg.Reasons.Dependencies[i] = testModuleName + dep
+		}
+		named = append(named, pkg)
 	}
+	return named
+}
+
+func TestWhy(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		patch    string
+		args     []string
+		expected []string
+	}{
+		{
+			name:  "changed file",
+			patch: "change-in-embedded-file.patch",
+			args:  []string{"why", testModuleName + "/cmd/db"},
+			expected: []string{
+				"# " + testModuleName + "/cmd/db",
+				testModuleName + "/cmd/db",
+				testModuleName + "/internal/sql",
+				"changed file: changedpkgs/testdata/repo/internal/sql/migration.sql",
+			},
+		},
+		{
+			name:  "changed module",
+			patch: "upgrade-first-level-dependency.patch",
+			args:  []string{"why", testModuleName},
+			expected: []string{
+				"# " + testModuleName,
+				testModuleName,
+				testModuleName + "/internal/consumer",
+				"changed module: golang.org/x/sys",
+			},
+		},
+		{
+			name:  "indirect change",
+			patch: "change-in-second-level-package.patch",
+			args:  []string{"why", testModuleName},
+			expected: []string{
+				"# " + testModuleName,
+				testModuleName,
+				testModuleName + "/internal/consumer",
+				testModuleName + "/internal/utils",
+				"changed file: changedpkgs/testdata/repo/internal/utils/files.go",
+			},
+		},
+		{
+			name:  "unchanged package",
+			patch: "change-in-embedded-file.patch",
+			args:  []string{"why", testModuleName + "/internal/utils"},
+			expected: []string{
+				"# " + testModuleName + "/internal/utils",
+				"(package " + testModuleName + "/internal/utils is not changed)",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+
+			err := runWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{tc.patch},
+				&buf,
+				tc.args...,
+			)
 
-	prePatchHead := getHeadCommit(t, repoDir)
-
-	for _, patch := range patchPaths {
-		mustRunGitCmd(t, "-C", repoDir, "apply", "--index", patch)
-		mustRunGitCmd(
-			t,
-			// avoid relying on local config to set user info
-			"-c",
-			"user.name=releaser-test",
-			"-c",
-			"user.email=releaser-test@example.com",
-			"-C",
-			repoDir,
-			"commit",
-			// avoid running any hooks that might be configured locally (e.g.
-			// from `pre-commit`)
-			"--no-verify",
-			"--message",
-			patch,
-		)
+			require.NoError(t, err)
+			require.Equal(t, strings.Join(tc.expected, "\n")+"\n", buf.String())
+		})
 	}
+}
+func TestWhyErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		args        []string
+		expectedErr string
+	}{
+		{
+			name:        "no package",
+			args:        []string{"why"},
+			expectedErr: "expected a single package argument, got 0",
+		},
+		{
+			name:        "many packages",
+			args:        []string{"why", testModuleName, testModuleName + "/cmd/db"},
+			expectedErr: "expected a single package argument, got 2",
+		},
+		{
+			name:        "failing to get changed packages",
+			args:        []string{"--mod-dir", "not-a-dir", "why", testModuleName},
+			expectedErr: "getting changed packages: ",
+		},
+		{
+			name:        "missing config",
+			args:        []string{"--config", "missing.yaml", "why", testModuleName},
+			expectedErr: "reading config file ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-	postPatchHead := getHeadCommit(t, repoDir)
-	return prePatchHead, postPatchHead
+			err := runWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{"change-in-embedded-file.patch"},
+				io.Discard,
+				tc.args...,
+			)
+
+			require.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
 }
 
-func TestErrorsWhenFailsToReadPackages(t *testing.T) {
+func TestDirFiles(t *testing.T) {
 	t.Parallel()
-	// create directory we don't have permission to search
-	modDir := filepath.Join(t.TempDir(), "moddir")
-	require.NoError(t, os.Mkdir(modDir, 0o666))
 
-	args := append( //nolint:gocritic
-		progArgs,
-		"--mod-dir",
-		modDir,
-		"--from-ref",
-		"",
-		"--to-ref",
-		"",
-	)
-	app := buildTestApp(io.Discard)
-	retCode, err := runApp(context.Background(), app, args)
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "dir files",
+			args:     []string{"--dir-files"},
+			expected: []string{testModuleName},
+		},
+		{
+			name:     "ignored",
+			args:     []string{"--dir-files", "--dir-files-ignore", "*.md"},
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
 
-	require.Equal(t, 1, retCode)
-	require.ErrorContains(t, err, "failed listing local packages: ")
+			err := runWithPatches(
+				t,
+				testrepo.SetupWorktree(t),
+				[]string{"change-in-unrelated-file.patch"},
+				&buf,
+				tc.args...,
+			)
+
+			require.NoError(t, err)
+			compareResults(t, tc.expected, buf)
+		})
+	}
 }
 
-func TestErrorsWhenFailstoListingChangedFiles(t *testing.T) {
+func TestConfig(t *testing.T) {
 	t.Parallel()
-	// directory isn't a Git repo
-	repoDir := t.TempDir()
+	config := []byte(`triggers:
+  - files: ["**/README.md"]
+    packages: ["./cmd/..."]
+`)
+
+	for _, tc := range []struct {
+		name string
+		// where to write the config, relative to the worktree
+		path string
+		// whether to commit the config, along with the patch
+		commit   bool
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "default path",
+			path:     ".go-changed-pkgs.yaml",
+			commit:   true,
+			expected: []string{testModuleName + "/cmd/db"},
+		},
+		{
+			name:     "relative path",
+			path:     "config.yaml",
+			commit:   true,
+			args:     []string{"--config", "config.yaml"},
+			expected: []string{testModuleName + "/cmd/db"},
+		},
+		{
+			// only the config at --to-ref is used
+			name:     "uncommitted default path",
+			path:     ".go-changed-pkgs.yaml",
+			expected: []string{},
+		},
+		{
+			name:     "no config",
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			worktreePath := testrepo.SetupWorktree(t)
+			if tc.path != "" {
+				require.NoError(t, os.WriteFile(filepath.Join(worktreePath, tc.path), config, 0o600))
+			}
+			if tc.commit {
+				mustRunGitCmd(t, "-C", worktreePath, "add", tc.path)
+			}
+			var buf bytes.Buffer
 
-	args := append( //nolint:gocritic
-		progArgs,
-		"--repo-dir",
-		repoDir,
-		"--from-ref",
-		"",
-		"--to-ref",
-		"",
-	)
-	app := buildTestApp(io.Discard)
-	retCode, err := runApp(context.Background(), app, args)
+			err := runWithPatches(
+				t,
+				worktreePath,
+				[]string{"change-in-unrelated-file.patch"},
+				&buf,
+				tc.args...,
+			)
 
-	require.Equal(t, 1, retCode)
-	require.ErrorContains(t, err, "listing changed files: running command: `git")
+			require.NoError(t, err)
+			compareResults(t, tc.expected, buf)
+		})
+	}
 }
 
-func TestErrorsWhenFailsToReadingGoMod(t *testing.T) {
+func TestConfigErrors(t *testing.T) {
 	t.Parallel()
-	worktreeName := "remove-go-mod"
+	configPath := filepath.Join(t.TempDir(), "missing.yaml")
 
 	err := runWithPatches(
 		t,
-		setupWorktree(t, worktreeName),
-		[]string{"remove-go-mod.patch"},
+		testrepo.SetupWorktree(t),
+		[]string{"change-in-unrelated-file.patch"},
 		io.Discard,
+		"--config",
+		configPath,
 	)
 
-	require.ErrorContains(t, err, "reading "+filepath.Join(modPath, "go.mod"))
+	require.ErrorContains(t, err, "reading config file "+configPath+": ")
 }
 
-func TestErrorsWhenFailingToParseGoMod(t *testing.T) {
+func TestWithoutToRef(t *testing.T) {
 	t.Parallel()
-	worktreePath := setupWorktree(t, "break-go-mod")
-	// break `go.mod`...
-	_, headSha := commitPatches(t, worktreePath, "break-go-mod.patch")
 
-	//  ...and then fix it again so we can process packages at HEAD
-	err := runWithPatches(t, worktreePath, []string{"fix-go-mod.patch"}, io.Discard)
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "working tree",
+			expected: []string{testModuleName + "/internal/sql", testModuleName + "/cmd/db", testModuleName},
+		},
+		{
+			name:     "index",
+			args:     []string{"--staged"},
+			expected: []string{testModuleName + "/internal/sql", testModuleName + "/cmd/db"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			worktreePath := testrepo.SetupWorktree(t)
+			// stage one change, and leave another unstaged
+			mustRunGitCmd(
+				t,
+				"-C",
+				worktreePath,
+				"apply",
+				"--index",
+				testrepo.PatchPath(t, "repo", "change-in-embedded-file.patch"),
+			)
+			mustRunGitCmd(t, "-C", worktreePath, "apply", testrepo.PatchPath(t, "repo", "change-in-top-level-package.patch"))
+			var buf bytes.Buffer
 
-	require.ErrorContains(
-		t,
-		err,
-		"parsing mod file "+filepath.Join(modPath, "go.mod")+" at "+headSha,
-	)
+			args := append( //nolint:gocritic
+				progArgs,
+				"--repo-dir",
+				worktreePath,
+				"--mod-dir",
+				testrepo.ModDir(worktreePath, "repo"),
+				"--from-ref",
+				"HEAD",
+			)
+			app := buildTestApp(&buf)
+			_, err := runApp(context.Background(), app, append(args, tc.args...))
+
+			require.NoError(t, err)
+			compareResults(t, tc.expected, buf)
+		})
+	}
 }
 
-func TestErrorsWhenFailsToQueryPackage(t *testing.T) {
+func TestErrorsWhenFailingToGetChangedPackages(t *testing.T) {
 	t.Parallel()
+	repoDir := t.TempDir()
+	modDir := t.TempDir()
 
-	err := runWithPatches(
-		t,
-		setupWorktree(t, "error-in-package"),
-		[]string{"syntax-error-in-package.patch"},
-		io.Discard,
+	args := append( //nolint:gocritic
+		progArgs,
+		"--repo-dir",
+		repoDir,
+		"--mod-dir",
+		modDir,
+		"--from-ref",
+		"",
+		"--to-ref",
+		"",
 	)
+	app := buildTestApp(io.Discard)
+	retCode, err := runApp(context.Background(), app, args)
 
-	require.ErrorContains(t, err, "failed querying package "+testModuleName)
+	require.Equal(t, 1, retCode)
+	require.ErrorContains(t, err, "getting changed packages: mod dir "+modDir+" is not inside repo dir "+repoDir)
 }
 
-func mustRunGitCmd(t *testing.T, args ...string) string {
+func compareResults(t *testing.T, expected []string, buf bytes.Buffer) {
 	t.Helper()
+	require.ElementsMatch(t, expected, getLines(buf))
+}
 
-	stdout, err := runGitCmd(context.Background(), args...)
-	require.NoError(t, err)
-	return stdout
+// add the test module's name to the relative package paths in `pkgs`.
+func addModuleName(pkgs []string) []string {
+	named := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		named = append(named, testModuleName+pkg)
+	}
+	return named
+}
+
+func getLines(buf bytes.Buffer) []string {
+	got := buf.String()
+	if got == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(got, "\n"), "\n")
 }
 
-func getHeadCommit(t *testing.T, repoPath string) string {
+func mustRunGitCmd(t *testing.T, args ...string) string {
 	t.Helper()
 
-	out := mustRunGitCmd(t, "-C", repoPath, "log", "--format=%H", "--max-count", "1")
-	return strings.TrimSuffix(out, "\n")
+	stdout, err := exec.Command("git", args...).Output()
+	require.NoError(t, err)
+	return string(stdout)
 }
 
 func buildTestApp(out io.Writer) *cli.App {
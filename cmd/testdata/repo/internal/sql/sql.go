@@ -1,10 +0,0 @@
-package sql
-
-import "C"
-
-import (
-	"embed"
-)
-
-//go:embed *.sql
-var fs embed.FS
@@ -0,0 +1,63 @@
+package flag
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ChoiceValue is a [cli.Generic] value that accepts one of a fixed set of
+// strings, for example
+//
+//	app := &cli.App{
+//		Flags: []cli.Flag{
+//			&cli.GenericFlag{
+//				Name:  "format",
+//				Value: flag.NewChoiceValue("text", "text", "json"),
+//			},
+//		},
+//		Action: func(ctx *cli.Context) error {
+//			format = ctx.Value("format").(string)
+//			return nil
+//		},
+//	}
+//
+// An error will be raised when setting the flag to anything other than one of
+// the choices.
+type ChoiceValue struct {
+	value   string
+	choices []string
+}
+
+// NewChoiceValue builds a [ChoiceValue] accepting any of `choices` and
+// defaulting to `value`.
+func NewChoiceValue(value string, choices ...string) *ChoiceValue {
+	return &ChoiceValue{value: value, choices: choices}
+}
+
+// Usage can be used as the `Usage` value for a [cli.Flag] that uses
+// the [ChoiceValue], listing the valid choices after `usage`.
+func (v *ChoiceValue) Usage(usage string) string {
+	return fmt.Sprintf("%s. Valid values are: %s", usage, strings.Join(v.choices, ", "))
+}
+
+func (v *ChoiceValue) Set(value string) error {
+	if slices.Contains(v.choices, value) {
+		v.value = value
+		return nil
+	}
+
+	return fmt.Errorf(
+		"invalid value %s: must be one of: %s",
+		value,
+		strings.Join(v.choices, ", "),
+	)
+}
+
+func (v *ChoiceValue) String() string {
+	return v.value
+}
+
+func (v *ChoiceValue) Get() any {
+	return v.value
+}
@@ -0,0 +1,98 @@
+package flag_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+
+	"github.com/utilitywarehouse/go-changed-pkgs/internal/flag"
+)
+
+func TestChoiceValue_ValidValues(t *testing.T) {
+	for _, choice := range []string{"text", "json"} {
+		t.Run(choice, func(t *testing.T) {
+			var got string
+			app := &cli.App{
+				Flags: []cli.Flag{
+					&cli.GenericFlag{
+						Name:  "format",
+						Value: flag.NewChoiceValue("text", "text", "json"),
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					got = ctx.Value("format").(string) //nolint:errcheck
+					return nil
+				},
+			}
+
+			err := app.Run([]string{"run", "--format", choice})
+
+			require.NoError(t, err)
+			require.Equal(t, choice, got)
+		})
+	}
+}
+
+func TestChoiceValue_Defaulting(t *testing.T) {
+	var got string
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.GenericFlag{
+				Name:  "format",
+				Value: flag.NewChoiceValue("text", "text", "json"),
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			got = ctx.Value("format").(string) //nolint:errcheck
+			return nil
+		},
+	}
+
+	err := app.Run([]string{"run"})
+
+	require.NoError(t, err)
+	require.Equal(t, "text", got)
+}
+
+func TestChoiceValue_InvalidValues(t *testing.T) {
+	for _, choice := range []string{
+		"yaml",
+		"",
+		"JSON",
+	} {
+		t.Run(choice, func(t *testing.T) {
+			app := &cli.App{
+				// avoid noise when running in verbose mode
+				// from the app printing its usage string when it sees an
+				// invalid flag
+				Writer: io.Discard,
+				Flags: []cli.Flag{
+					&cli.GenericFlag{
+						Name:  "format",
+						Value: flag.NewChoiceValue("text", "text", "json"),
+					},
+				},
+			}
+
+			err := app.Run([]string{"run", "--format", choice})
+
+			require.ErrorContains(
+				t,
+				err,
+				"invalid value "+choice+": must be one of: text, json",
+			)
+		})
+	}
+}
+
+func TestChoiceValue_Usage(t *testing.T) {
+	value := flag.NewChoiceValue("text", "text", "json")
+
+	require.Equal(
+		t,
+		"The output format. Valid values are: text, json",
+		value.Usage("The output format"),
+	)
+}
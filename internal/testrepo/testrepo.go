@@ -0,0 +1,152 @@
+// Package testrepo has helpers for tests that commit patches to the test
+// modules under changedpkgs/testdata, shared by the tests of the changedpkgs
+// package and the CLI.
+package testrepo
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// how long a lock on `git worktree` commands can be held before it's assumed
+// the test holding it was killed. The commands only take a moment.
+const staleLockAge = time.Minute
+
+// SetupWorktree adds a new worktree of the current repo for the test, to
+// avoid polluting the current repo, which also lets tests run in parallel.
+func SetupWorktree(t testing.TB) string {
+	t.Helper()
+	worktreePath := filepath.Join(t.TempDir(), "worktree")
+	lockPath := filepath.Join(
+		strings.TrimSuffix(runGitCmd(t, "rev-parse", "--path-format=absolute", "--git-common-dir"), "\n"),
+		"go-changed-pkgs-worktree.lock",
+	)
+
+	unlock := lockWorktrees(t, lockPath)
+	defer unlock()
+	// --detach to avoid creating a new branch in the current repo
+	runGitCmd(t, "worktree", "add", "--quiet", "--detach", worktreePath)
+	t.Cleanup(func() {
+		unlock := lockWorktrees(t, lockPath)
+		defer unlock()
+		// try to cleanup the worktree, just to be polite
+		// but the TempDir should be deleted at the end of the test run regardless
+		out, err := exec.Command("git", "worktree", "remove", "--force", worktreePath).CombinedOutput()
+		if err != nil { //go-cov:skip // we don't expect a failure, and only log it
+			t.Logf(
+				"failed to remove worktree at %s (you may want to manually remove it): %v: %s",
+				worktreePath,
+				err,
+				out,
+			)
+		}
+	})
+
+	return worktreePath
+}
+
+// take the lock file at `lockPath`, returning a function to release it.
+// Concurrent `git worktree` commands can fail, and the tests of each package
+// run in their own process, so a mutex isn't enough.
+func lockWorktrees(t testing.TB, lockPath string) func() {
+	t.Helper()
+	for {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			require.NoError(t, file.Close())
+			return func() { require.NoError(t, os.Remove(lockPath)) }
+		}
+		require.ErrorIs(t, err, fs.ErrExist)
+
+		info, err := os.Stat(lockPath)
+		if err == nil && time.Since(info.ModTime()) > staleLockAge {
+			// another test may remove it first
+			if err := os.Remove(lockPath); !errors.Is(err, fs.ErrNotExist) {
+				require.NoError(t, err)
+			}
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// PatchPath gets the path to the patch with the given name for the test
+// module `module` under changedpkgs/testdata, like "repo" or "replace/app",
+// from the patches directory of its top directory, e.g. "replace/patches".
+func PatchPath(t testing.TB, module string, patchName string) string {
+	t.Helper()
+	repoDir := strings.TrimSuffix(runGitCmd(t, "rev-parse", "--show-toplevel"), "\n")
+	topDir, _, _ := strings.Cut(module, "/")
+	return filepath.Join(repoDir, "changedpkgs", "testdata", topDir, "patches", patchName)
+}
+
+// ModDir gets the directory of the test module `module` in the worktree.
+func ModDir(worktreePath string, module string) string {
+	return filepath.Join(worktreePath, "changedpkgs", "testdata", filepath.FromSlash(module))
+}
+
+// CommitModulePatches commits the patches with the given names for the test
+// module `module`, as for [PatchPath], like [CommitPatches].
+func CommitModulePatches(t testing.TB, worktreePath string, module string, patchNames ...string) (string, string) {
+	t.Helper()
+	patchPaths := make([]string, 0, len(patchNames))
+	for _, patchName := range patchNames {
+		patchPaths = append(patchPaths, PatchPath(t, module, patchName))
+	}
+	return CommitPatches(t, worktreePath, patchPaths...)
+}
+
+// CommitPatches applies each patch file to the index of the repo at
+// `repoDir` and commits it, returning the commits before and after the
+// patches.
+func CommitPatches(t testing.TB, repoDir string, patchPaths ...string) (string, string) {
+	t.Helper()
+	prePatchHead := HeadCommit(t, repoDir)
+
+	for _, patch := range patchPaths {
+		runGitCmd(t, "-C", repoDir, "apply", "--index", patch)
+		runGitCmd(
+			t,
+			// avoid relying on local config to set user info
+			"-c",
+			"user.name=releaser-test",
+			"-c",
+			"user.email=releaser-test@example.com",
+			"-C",
+			repoDir,
+			"commit",
+			// avoid running any hooks that might be configured locally (e.g.
+			// from `pre-commit`)
+			"--no-verify",
+			"--message",
+			patch,
+		)
+	}
+
+	postPatchHead := HeadCommit(t, repoDir)
+	return prePatchHead, postPatchHead
+}
+
+// HeadCommit gets the commit checked out in the repo at `repoDir`.
+func HeadCommit(t testing.TB, repoDir string) string {
+	t.Helper()
+
+	out := runGitCmd(t, "-C", repoDir, "log", "--format=%H", "--max-count", "1")
+	return strings.TrimSuffix(out, "\n")
+}
+
+func runGitCmd(t testing.TB, args ...string) string {
+	t.Helper()
+
+	stdout, err := exec.Command("git", args...).Output()
+	require.NoError(t, err)
+	return string(stdout)
+}
@@ -0,0 +1,92 @@
+package testrepo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitPatches(t *testing.T) {
+	t.Parallel()
+	repoDir := t.TempDir()
+	filePath := filepath.Join(repoDir, "file.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("old\n"), 0o600))
+	runGitCmd(t, "-C", repoDir, "init", "--quiet")
+	runGitCmd(t, "-C", repoDir, "add", "file.txt")
+	runGitCmd(
+		t,
+		"-c",
+		"user.name=releaser-test",
+		"-c",
+		"user.email=releaser-test@example.com",
+		"-C",
+		repoDir,
+		"commit",
+		"--quiet",
+		"--no-verify",
+		"--message",
+		"initial",
+	)
+	patchPath := filepath.Join(t.TempDir(), "change.patch")
+	require.NoError(t, os.WriteFile(patchPath, []byte(`--- a/file.txt
++++ b/file.txt
+@@ -1 +1 @@
+-old
++new
+`), 0o600))
+
+	prePatchHead, postPatchHead := CommitPatches(t, repoDir, patchPath)
+
+	require.NotEqual(t, prePatchHead, postPatchHead)
+	require.Equal(t, postPatchHead, HeadCommit(t, repoDir))
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, "new\n", string(data))
+	require.Empty(t, runGitCmd(t, "-C", repoDir, "status", "--porcelain"))
+}
+
+func TestCommitModulePatches(t *testing.T) {
+	t.Parallel()
+	worktreePath := SetupWorktree(t)
+
+	prePatchHead, postPatchHead := CommitModulePatches(t, worktreePath, "replace/app", "remove-go-version.patch")
+
+	require.NotEqual(t, prePatchHead, postPatchHead)
+	require.FileExists(t, filepath.Join(ModDir(worktreePath, "replace/app"), "go.mod"))
+	require.Empty(t, runGitCmd(t, "-C", worktreePath, "status", "--porcelain"))
+}
+
+func TestLockWorktreesWaitsForLock(t *testing.T) {
+	t.Parallel()
+	lockPath := filepath.Join(t.TempDir(), "worktree.lock")
+	unlock := lockWorktrees(t, lockPath)
+	locked := make(chan func())
+
+	go func() { locked <- lockWorktrees(t, lockPath) }()
+
+	select {
+	case <-locked:
+		require.Fail(t, "took lock while it was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	(<-locked)()
+	require.NoFileExists(t, lockPath)
+}
+
+func TestLockWorktreesTakesStaleLock(t *testing.T) {
+	t.Parallel()
+	lockPath := filepath.Join(t.TempDir(), "worktree.lock")
+	require.NoError(t, os.WriteFile(lockPath, nil, 0o600))
+	staleTime := time.Now().Add(-2 * staleLockAge)
+	require.NoError(t, os.Chtimes(lockPath, staleTime, staleTime))
+
+	unlock := lockWorktrees(t, lockPath)
+
+	require.FileExists(t, lockPath)
+	unlock()
+	require.NoFileExists(t, lockPath)
+}